@@ -4,13 +4,15 @@ go 1.12
 
 require (
 	github.com/imdario/mergo v0.3.7 // indirect
+	github.com/prometheus/client_golang v0.9.3
 	golang.org/x/crypto v0.0.0-20190513172903-22d7a77e9e5f // indirect
 	golang.org/x/oauth2 v0.0.0-20190523182746-aaccbc9213b0 // indirect
-	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4 // indirect
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
 	k8s.io/api v0.0.0-20190515023547-db5a9d1c40eb
 	k8s.io/apimachinery v0.0.0-20190515023456-b74e4c97951f
 	k8s.io/client-go v0.0.0-20190515063710-7b18d6600f6b
 	k8s.io/code-generator v0.0.0-20190511023357-639c964206c2 // indirect
+	k8s.io/klog v0.3.0
 	k8s.io/utils v0.0.0-20190520173318-324c5df7d3f0 // indirect
 	sigs.k8s.io/controller-runtime v0.1.10
 )
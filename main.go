@@ -1,28 +1,107 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"time"
+	"hash/fnv"
+	"net/http"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	clientset "github.com/hrishin/podset-operator/pkg/client/clientset/versioned"
 	sampleScheme "github.com/hrishin/podset-operator/pkg/client/clientset/versioned/scheme"
+	psinformers "github.com/hrishin/podset-operator/pkg/client/informers/externalversions"
 	poc "github.com/hrishin/podset-operator/pkg/controller"
+	"github.com/hrishin/podset-operator/pkg/logging"
 	"github.com/hrishin/podset-operator/pkg/signals"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/rand"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	kubeinformers "k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	kubeinformers "k8s.io/client-go/informers"
-	psinformers "github.com/hrishin/podset-operator/pkg/client/informers/externalversions"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog"
 )
 
 func main() {
 	kubeconfig := ""
 	flag.StringVar(&kubeconfig, "kubeconfig", kubeconfig, "kubeconfig file")
+	leaderElect := false
+	flag.BoolVar(&leaderElect, "leader-elect", leaderElect, "Start a leader election client and gain leadership before running the controller. Enable this when running replicated operators for high availability.")
+	leaderElectNamespace := "default"
+	flag.StringVar(&leaderElectNamespace, "leader-elect-namespace", leaderElectNamespace, "Namespace of the lock object used for leader election.")
+	leaderElectResourceLock := resourcelock.LeasesResourceLock
+	flag.StringVar(&leaderElectResourceLock, "leader-elect-resource-lock", leaderElectResourceLock, "Type of the lock object used for leader election, 'leases' or 'configmaps'.")
+	leaseDuration := 15 * time.Second
+	flag.DurationVar(&leaseDuration, "leader-elect-lease-duration", leaseDuration, "Duration non-leader candidates wait after observing a leadership renewal before attempting to acquire leadership.")
+	renewDeadline := 10 * time.Second
+	flag.DurationVar(&renewDeadline, "leader-elect-renew-deadline", renewDeadline, "Duration the leader retries refreshing leadership before giving it up.")
+	retryPeriod := 2 * time.Second
+	flag.DurationVar(&retryPeriod, "leader-elect-retry-period", retryPeriod, "Duration the clients wait between attempts of acquiring or renewing leadership.")
+	metricsAddr := ":8080"
+	flag.StringVar(&metricsAddr, "metrics-addr", metricsAddr, "Address the Prometheus metrics endpoint binds to, empty to disable it.")
+	healthAddr := ":8081"
+	flag.StringVar(&healthAddr, "health-addr", healthAddr, "Address the /healthz and /readyz probe endpoints bind to, empty to disable them.")
+	workerTimeout := 5 * time.Minute
+	flag.DurationVar(&workerTimeout, "worker-timeout", workerTimeout, "Duration after which a worker still processing the same PodSet is reported unhealthy by /healthz.")
+	var namespaces namespacesFlag
+	flag.Var(&namespaces, "namespace", "Namespace to watch, repeat the flag or separate the namespaces with commas to watch several. All namespaces are watched by default.")
+	podSetSelector := ""
+	flag.StringVar(&podSetSelector, "podset-selector", podSetSelector, "Label selector of the PodSets this instance syncs, all of them by default.")
+	shardIndex := 0
+	flag.IntVar(&shardIndex, "shard-index", shardIndex, "Index of this instance among --shard-count instances, it syncs the PodSets whose namespace/name hashes to it.")
+	shardCount := 1
+	flag.IntVar(&shardCount, "shard-count", shardCount, "Number of instances sharing the PodSets by hash of their namespace/name.")
+	workers := 1
+	flag.IntVar(&workers, "workers", workers, "Number of PodSets synced concurrently.")
+	resyncPeriod := 10 * time.Minute
+	flag.DurationVar(&resyncPeriod, "resync-period", resyncPeriod, "Period of the informers resync, every PodSet is synced again at least this often.")
+	kubeAPIQPS := float64(rest.DefaultQPS)
+	flag.Float64Var(&kubeAPIQPS, "kube-api-qps", kubeAPIQPS, "QPS to use while talking with the Kubernetes API server.")
+	kubeAPIBurst := rest.DefaultBurst
+	flag.IntVar(&kubeAPIBurst, "kube-api-burst", kubeAPIBurst, "Burst to use while talking with the Kubernetes API server.")
+	workqueueBaseDelay := 5 * time.Millisecond
+	flag.DurationVar(&workqueueBaseDelay, "workqueue-base-delay", workqueueBaseDelay, "Delay before the first retry of a PodSet which failed to sync, doubled on every failure.")
+	workqueueMaxDelay := 1000 * time.Second
+	flag.DurationVar(&workqueueMaxDelay, "workqueue-max-delay", workqueueMaxDelay, "Maximum delay between the retries of a PodSet which fails to sync.")
+	logFormat := logging.TextFormat
+	flag.StringVar(&logFormat, "log-format", logFormat, "Format of the log lines, 'text' or 'json'.")
+	// -v, -vmodule, -logtostderr, ...
+	klog.InitFlags(nil)
 	flag.Parse()
+	defer klog.Flush()
+
+	if err := logging.SetFormat(logFormat); err != nil {
+		exitOnError(err, "Invalid flags")
+	}
+	if logFormat == logging.JSONFormat {
+		// the klog headers would break the JSON lines
+		utilruntime.Must(flag.Set("skip_headers", "true"))
+	}
+	selector, err := labels.Parse(podSetSelector)
+	if err != nil {
+		exitOnError(err, "Invalid --podset-selector")
+	}
+	if shardCount < 1 || shardIndex < 0 || shardIndex >= shardCount {
+		exitOnError(fmt.Errorf("--shard-index must be in [0, %d)", shardCount), "Invalid flags")
+	}
+	sharding := poc.Sharding{Selector: selector, Index: shardIndex, Count: shardCount}
+
+	// keep the rate limiting of the default handlers, only replace the
+	// logging one
+	utilruntime.ErrorHandlers[0] = func(err error) {
+		logging.Error(err, "Unhandled error")
+	}
 
 	// set up signals so we handle the first shutdown signal gracefully
 	stopCh := signals.SetupSignalHandler()
@@ -31,39 +110,232 @@ func main() {
 		kubeconfig = os.Getenv("KUBECONFIG")
 	}
 
-	var (
-		config *rest.Config
-		err    error
-	)
-
+	var config *rest.Config
 	if kubeconfig != "" {
 		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
 	} else {
 		config, err = rest.InClusterConfig()
 	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error creating client: %v", err)
-		os.Exit(1)
+		exitOnError(err, "Error creating client")
 	}
 
+	config.QPS = float32(kubeAPIQPS)
+	config.Burst = kubeAPIBurst
+
 	k8sClient := kubernetes.NewForConfigOrDie(config)
 	psClient := clientset.NewForConfigOrDie(config)
 
+	// serve the metrics on every replica, leader or not
+	if metricsAddr != "" {
+		go serveMetrics(metricsAddr)
+	}
+
+	// The checks are swapped once the controller runs, until then the
+	// replica is alive but not ready.
+	var healthCheck, readyCheck atomic.Value
+	healthCheck.Store(func() error { return nil })
+	readyCheck.Store(func() error { return fmt.Errorf("controller not started") })
+	if healthAddr != "" {
+		go serveHealth(healthAddr, &healthCheck, &readyCheck)
+	}
+
 	// To check if PodSet resource exist
 	utilruntime.Must(sampleScheme.AddToScheme(scheme.Scheme))
 
-	k8sInformerFactory := kubeinformers.NewSharedInformerFactory(k8sClient, time.Minute * 10)
-	psInformerFactory := psinformers.NewSharedInformerFactory(psClient, time.Minute * 10)
+	run := func(stopCh <-chan struct{}) {
+		watched := []string(namespaces)
+		if len(watched) == 0 {
+			watched = []string{metav1.NamespaceAll}
+		}
+
+		// one pair of factories per namespace, so that only namespaced
+		// list and watch permissions are needed
+		var (
+			informers    []poc.NamespaceInformers
+			nodeInformer coreinformers.NodeInformer
+			factories    []interface{ Start(<-chan struct{}) }
+		)
+		for _, ns := range watched {
+			k8sInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(k8sClient, resyncPeriod, kubeinformers.WithNamespace(ns))
+			// only the selected PodSets are cached
+			psInformerFactory := psinformers.NewSharedInformerFactoryWithOptions(psClient, resyncPeriod,
+				psinformers.WithNamespace(ns),
+				psinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+					options.LabelSelector = podSetSelector
+				}))
+			informers = append(informers, poc.NamespaceInformers{
+				Namespace:           ns,
+				Pods:                poc.NewPodInformer(k8sInformerFactory, ns),
+				PodSets:             psInformerFactory.Demo().V1alpha1().PodSets(),
+				ControllerRevisions: k8sInformerFactory.Apps().V1().ControllerRevisions(),
+			})
+			// nodes are cluster scoped, they can't be watched with
+			// namespaced permissions
+			if ns == metav1.NamespaceAll {
+				nodeInformer = k8sInformerFactory.Core().V1().Nodes()
+			}
+			factories = append(factories, k8sInformerFactory, psInformerFactory)
+		}
 
-	psc := poc.New(k8sClient, psClient, 
-		k8sInformerFactory.Core().V1().Pods(), 
-		psInformerFactory.Demo().V1alpha1().PodSets())
+		psc := poc.New(k8sClient, psClient,
+			informers,
+			nodeInformer,
+			poc.NewRateLimiter(workqueueBaseDelay, workqueueMaxDelay),
+			sharding)
+		healthCheck.Store(func() error { return psc.Healthy(workerTimeout) })
+		readyCheck.Store(psc.Ready)
 
-	k8sInformerFactory.Start(stopCh)
-	psInformerFactory.Start(stopCh)
+		// the pods created before the pod informers only watched the
+		// labelled ones must be labelled before the informers start
+		for _, ns := range watched {
+			if err := poc.LabelPodSetPods(k8sClient, psClient, ns); err != nil {
+				logging.Error(err, "Error labelling the pods of PodSets", "namespace", ns)
+			}
+		}
+		for _, factory := range factories {
+			factory.Start(stopCh)
+		}
 
-	if err := psc.Run(1, stopCh); err != nil {
-		fmt.Fprintf(os.Stderr, "error running controller: %v", err)
-		os.Exit(1)
+		if err := psc.Run(workers, stopCh); err != nil {
+			exitOnError(err, "Error running controller")
+		}
 	}
+
+	if !leaderElect {
+		run(stopCh)
+		return
+	}
+
+	// only one replica of the operator runs the controller at a time, the
+	// others wait to take over
+	id, err := os.Hostname()
+	if err != nil {
+		exitOnError(err, "Error getting hostname")
+	}
+	id = id + "_" + rand.String(8)
+
+	// every shard elects its own leader
+	lockName := leaderElectionLockName(selector, shardIndex, shardCount)
+	lock, err := resourcelock.New(leaderElectResourceLock,
+		leaderElectNamespace,
+		lockName,
+		k8sClient.CoreV1(),
+		k8sClient.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: id})
+	if err != nil {
+		exitOnError(err, "Error creating leader election lock")
+	}
+
+	// A replica waiting for the leadership is ready, otherwise the rollout
+	// of the operator would wait forever on its standby replicas. It turns
+	// not ready until its caches are synced once it takes over.
+	readyCheck.Store(func() error { return nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            lockName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				run(ctx.Done())
+			},
+			OnStoppedLeading: func() {
+				// Either we are shutting down or another replica took
+				// over, the workers can't be trusted to stop in time so
+				// exit right away.
+				if ctx.Err() == nil {
+					logging.Info("Leader election lost", "identity", id)
+				}
+				klog.Flush()
+				os.Exit(0)
+			},
+		},
+	})
+}
+
+// serveMetrics exposes the Prometheus metrics on /metrics.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		exitOnError(err, "Error serving metrics")
+	}
+}
+
+// serveHealth exposes the liveness and readiness checks on /healthz and
+// /readyz, the checks hold a func() error.
+func serveHealth(addr string, healthCheck, readyCheck *atomic.Value) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", checkHandler(healthCheck))
+	mux.HandleFunc("/readyz", checkHandler(readyCheck))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		exitOnError(err, "Error serving health probes")
+	}
+}
+
+func checkHandler(check *atomic.Value) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := check.Load().(func() error)(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}
+}
+
+// namespacesFlag collects the namespaces of a repeated, comma-separated flag.
+// leaderElectionLockName returns the name of the leader election lock of the
+// shard: podset-operator, suffixed with the shard index and count, and with a
+// hash of the PodSet selector.
+func leaderElectionLockName(selector labels.Selector, shardIndex, shardCount int) string {
+	name := "podset-operator"
+	if shardCount > 1 {
+		name = fmt.Sprintf("%s-%d-of-%d", name, shardIndex, shardCount)
+	}
+	if !selector.Empty() {
+		hasher := fnv.New32a()
+		hasher.Write([]byte(selector.String()))
+		name = fmt.Sprintf("%s-%08x", name, hasher.Sum32())
+	}
+	return name
+}
+
+type namespacesFlag []string
+
+func (n *namespacesFlag) String() string {
+	return strings.Join(*n, ",")
+}
+
+func (n *namespacesFlag) Set(value string) error {
+	for _, ns := range strings.Split(value, ",") {
+		ns = strings.TrimSpace(ns)
+		if ns == "" {
+			continue
+		}
+		duplicate := false
+		for _, existing := range *n {
+			duplicate = duplicate || existing == ns
+		}
+		if !duplicate {
+			*n = append(*n, ns)
+		}
+	}
+	return nil
+}
+
+// exitOnError logs the error and exits.
+func exitOnError(err error, msg string) {
+	logging.Error(err, msg)
+	klog.Flush()
+	os.Exit(1)
 }
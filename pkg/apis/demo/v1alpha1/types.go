@@ -1,7 +1,9 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // +genclient
@@ -19,11 +21,232 @@ type PodSet struct {
 // PodSetSpec is the spec for a PodSet resource
 type PodSetSpec struct {
 	Replicas int32 `json:"replicas"`
+
+	// Selector is a label query over pods that should match the replica count.
+	// It must match the pod template's labels. Defaults to app=<name> when
+	// not set.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	// MinReadySeconds is the minimum number of seconds for which a newly
+	// created pod should be ready to be considered available. Defaults to 0,
+	// i.e. a pod is available as soon as it is ready.
+	// +optional
+	MinReadySeconds int32 `json:"minReadySeconds,omitempty"`
+
+	// Template describes the pods that will be created.
+	Template corev1.PodTemplateSpec `json:"template"`
+
+	// Strategy is the strategy used to replace existing pods with new ones
+	// when the template changes.
+	// +optional
+	Strategy PodSetStrategy `json:"strategy,omitempty"`
+
+	// ScaleDownPolicy selects the pods deleted when there are too many of
+	// them. Defaults to NotReadyFirst. Whatever the policy, pods with a lower
+	// controller.kubernetes.io/pod-deletion-cost annotation are deleted
+	// first.
+	// +optional
+	ScaleDownPolicy ScaleDownPolicy `json:"scaleDownPolicy,omitempty"`
+
+	// FailedPodsHistoryLimit is the number of terminated (Failed or
+	// Succeeded) pods to keep for debugging, the most recent ones are kept.
+	// Defaults to 0, i.e. terminated pods are deleted as soon as the
+	// controller sees them.
+	// +optional
+	FailedPodsHistoryLimit *int32 `json:"failedPodsHistoryLimit,omitempty"`
+
+	// RevisionHistoryLimit is the number of old template revisions to keep
+	// to allow rollbacks. Defaults to 10.
+	// +optional
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
+
+	// RollbackTo asks the controller to roll the template back to a previous
+	// revision. The controller clears it once the template is restored.
+	// +optional
+	RollbackTo *RollbackConfig `json:"rollbackTo,omitempty"`
+
+	// TeardownBatchSize is the number of pods deleted at once when a PodSet
+	// carrying the demo.k8s.io/ordered-teardown finalizer is deleted, the
+	// next pods are deleted once the previous ones terminated. Defaults to
+	// 1.
+	// +optional
+	TeardownBatchSize *int32 `json:"teardownBatchSize,omitempty"`
+
+	// TeardownGracePeriodSeconds is the grace period of the pods deleted by
+	// the ordered teardown. Defaults to the terminationGracePeriodSeconds of
+	// the pods.
+	// +optional
+	TeardownGracePeriodSeconds *int64 `json:"teardownGracePeriodSeconds,omitempty"`
+}
+
+// OrderedTeardownFinalizer makes the controller delete the pods of a deleted
+// PodSet teardownBatchSize at a time before the PodSet goes away, instead of
+// leaving them all to the garbage collector at once.
+const OrderedTeardownFinalizer = "demo.k8s.io/ordered-teardown"
+
+// ScaleDownPolicy is the policy used to pick the pods to delete
+type ScaleDownPolicy string
+
+const (
+	// NotReadyFirstScaleDownPolicy deletes the pods the same way the
+	// ReplicaSet controller does: unscheduled, pending and not ready pods
+	// first, then the pods sharing a node, the ones ready for the least
+	// time, restarting the most, and finally the newest ones.
+	NotReadyFirstScaleDownPolicy ScaleDownPolicy = "NotReadyFirst"
+	// NewestScaleDownPolicy deletes the most recently created pods first.
+	NewestScaleDownPolicy ScaleDownPolicy = "Newest"
+	// OldestScaleDownPolicy deletes the least recently created pods first.
+	OldestScaleDownPolicy ScaleDownPolicy = "Oldest"
+	// MostLoadedNodeScaleDownPolicy deletes pods from the nodes running the
+	// most pods of the PodSet first.
+	MostLoadedNodeScaleDownPolicy ScaleDownPolicy = "MostLoadedNode"
+	// ZoneBalancedScaleDownPolicy deletes pods from the zones running the
+	// most pods of the PodSet first, keeping the pods spread across zones.
+	ZoneBalancedScaleDownPolicy ScaleDownPolicy = "ZoneBalanced"
+)
+
+// RollbackConfig describes the revision to roll back to
+type RollbackConfig struct {
+	// Revision to roll back to. 0 means the revision before the current
+	// one.
+	// +optional
+	Revision int64 `json:"revision,omitempty"`
+}
+
+// PodSetStrategyType is the type of a PodSet strategy
+type PodSetStrategyType string
+
+const (
+	// RecreatePodSetStrategyType kills all the existing pods before creating
+	// new ones.
+	RecreatePodSetStrategyType PodSetStrategyType = "Recreate"
+	// RollingUpdatePodSetStrategyType gradually replaces the old pods by new
+	// ones. It is the default strategy.
+	RollingUpdatePodSetStrategyType PodSetStrategyType = "RollingUpdate"
+)
+
+// PodSetStrategy describes how to replace existing pods with new ones
+type PodSetStrategy struct {
+	// Type of the strategy, either Recreate or RollingUpdate. Defaults to
+	// RollingUpdate.
+	// +optional
+	Type PodSetStrategyType `json:"type,omitempty"`
+
+	// RollingUpdate configures the rolling update, only used when the type
+	// is RollingUpdate.
+	// +optional
+	RollingUpdate *RollingUpdatePodSet `json:"rollingUpdate,omitempty"`
+}
+
+// RollingUpdatePodSet controls the pace of a rolling update
+type RollingUpdatePodSet struct {
+	// MaxUnavailable is the maximum number, or percentage of the desired
+	// replicas, of pods that can be unavailable during the update. Rounded
+	// down. Defaults to 25%.
+	// +optional
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+
+	// MaxSurge is the maximum number, or percentage of the desired
+	// replicas, of pods that can be created above the desired replicas
+	// during the update. Rounded up. Defaults to 25%.
+	// +optional
+	MaxSurge *intstr.IntOrString `json:"maxSurge,omitempty"`
 }
 
 // PodSetStatus is the status for a PodSet resource
 type PodSetStatus struct {
-	AvailableReplicas int32 `json:"availableReplicas"`
+	// Replicas is the number of active (pending or running) pods.
+	Replicas int32 `json:"replicas"`
+
+	// ReadyReplicas is the number of pods with a Ready condition.
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// UpdatedReplicas is the number of active pods running the current
+	// template.
+	// +optional
+	UpdatedReplicas int32 `json:"updatedReplicas,omitempty"`
+
+	// AvailableReplicas is the number of pods ready for at least
+	// minReadySeconds.
+	// +optional
+	AvailableReplicas int32 `json:"availableReplicas,omitempty"`
+
+	// TerminatedReplicas is the number of terminated pods kept because of
+	// failedPodsHistoryLimit.
+	// +optional
+	TerminatedReplicas int32 `json:"terminatedReplicas,omitempty"`
+
+	// ReplacedReplicas is the number of terminated pods the controller
+	// replaced and deleted over the PodSet's lifetime. It is best effort,
+	// the pods deleted by a sync whose status update fails aren't counted.
+	// +optional
+	ReplacedReplicas int64 `json:"replacedReplicas,omitempty"`
+
+	// ObservedGeneration is the most recent generation observed by the
+	// controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Selector is the label selector of the pods in its string form, as
+	// expected by the scale subresource and the HorizontalPodAutoscaler.
+	// +optional
+	Selector string `json:"selector,omitempty"`
+
+	// CurrentRevision is the name of the ControllerRevision the pods ran
+	// before the ongoing update. It equals UpdateRevision once all the pods
+	// are updated.
+	// +optional
+	CurrentRevision string `json:"currentRevision,omitempty"`
+
+	// UpdateRevision is the name of the ControllerRevision of the current
+	// template.
+	// +optional
+	UpdateRevision string `json:"updateRevision,omitempty"`
+
+	// CollisionCount is the number of times the name of the
+	// ControllerRevision of a template was taken by another object. It is
+	// appended to the names of the new revisions to avoid the collision.
+	// +optional
+	CollisionCount *int32 `json:"collisionCount,omitempty"`
+
+	// Conditions represent the latest available observations of the
+	// PodSet's current state.
+	// +optional
+	Conditions []PodSetCondition `json:"conditions,omitempty"`
+}
+
+// PodSetConditionType is the type of a PodSet condition
+type PodSetConditionType string
+
+const (
+	// PodSetAvailable means all the desired replicas of the PodSet are
+	// available.
+	PodSetAvailable PodSetConditionType = "Available"
+	// PodSetProgressing means the PodSet is scaling towards its desired
+	// replicas, or has reached them.
+	PodSetProgressing PodSetConditionType = "Progressing"
+	// PodSetReplicaFailure is added when one of the PodSet's pods fails to be
+	// created or deleted.
+	PodSetReplicaFailure PodSetConditionType = "ReplicaFailure"
+)
+
+// PodSetCondition describes the state of a PodSet at a certain point
+type PodSetCondition struct {
+	// Type of PodSet condition.
+	Type PodSetConditionType `json:"type"`
+	// Status of the condition, one of True, False, Unknown.
+	Status corev1.ConditionStatus `json:"status"`
+	// The last time the condition transitioned from one status to another.
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// The reason for the condition's last transition.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// A human readable message indicating details about the transition.
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -0,0 +1,42 @@
+package v1alpha1
+
+import (
+	scheme "github.com/hrishin/podset-operator/pkg/client/clientset/versioned/scheme"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The PodSetExpansion interface allows manually adding extra methods to the
+// PodSetInterface.
+type PodSetExpansion interface {
+	GetScale(podSetName string, options v1.GetOptions) (*autoscalingv1.Scale, error)
+	UpdateScale(podSetName string, scale *autoscalingv1.Scale) (*autoscalingv1.Scale, error)
+}
+
+// GetScale takes name of the podSet, and returns the corresponding scale object, and an error if there is any.
+func (c *podSets) GetScale(podSetName string, options v1.GetOptions) (result *autoscalingv1.Scale, err error) {
+	result = &autoscalingv1.Scale{}
+	err = c.client.Get().
+		Namespace(c.ns).
+		Resource("podsets").
+		Name(podSetName).
+		SubResource("scale").
+		VersionedParams(&options, scheme.ParameterCodec).
+		Do().
+		Into(result)
+	return
+}
+
+// UpdateScale takes the representation of a scale and updates it. Returns the server's representation of the scale, and an error, if there is any.
+func (c *podSets) UpdateScale(podSetName string, scale *autoscalingv1.Scale) (result *autoscalingv1.Scale, err error) {
+	result = &autoscalingv1.Scale{}
+	err = c.client.Put().
+		Namespace(c.ns).
+		Resource("podsets").
+		Name(podSetName).
+		SubResource("scale").
+		Body(scale).
+		Do().
+		Into(result)
+	return
+}
@@ -0,0 +1,168 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/hrishin/podset-operator/pkg/apis/demo/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+// claimPods returns the pods controlled by the PodSet, whatever their phase,
+// the way the PodControllerRefManager of the upstream controllers does: the
+// orphan pods matching the selector are adopted, and the controlled pods
+// which stopped matching it are released.
+func (c *podSetController) claimPods(ps *v1alpha1.PodSet, selector labels.Selector) ([]*corev1.Pod, error) {
+	claimed := []*corev1.Pod{}
+
+	nc, err := c.cacheFor(ps.Namespace)
+	if err != nil {
+		return claimed, err
+	}
+	controlled, err := nc.podIndexer.ByIndex(controllerUIDIndex, string(ps.UID))
+	if err != nil {
+		return claimed, fmt.Errorf("Error in retriving pods: %v", err)
+	}
+	namespaced, err := nc.podIndexer.ByIndex(cache.NamespaceIndex, ps.Namespace)
+	if err != nil {
+		return claimed, fmt.Errorf("Error in retriving pods: %v", err)
+	}
+
+	canAdopt := c.canAdoptFunc(ps)
+	var errs []error
+	// the controlled pods are listed twice
+	seen := map[types.UID]bool{}
+	for _, obj := range append(controlled, namespaced...) {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || pod.Namespace != ps.Namespace || seen[pod.UID] {
+			continue
+		}
+		seen[pod.UID] = true
+		matches := selector.Matches(labels.Set(pod.Labels))
+
+		controllerRef := metav1.GetControllerOf(pod)
+		if controllerRef != nil {
+			if controllerRef.UID != ps.UID {
+				continue
+			}
+			if matches {
+				claimed = append(claimed, pod)
+				continue
+			}
+			// A PodSet being deleted lets the garbage collector deal
+			// with its pods.
+			if ps.DeletionTimestamp != nil {
+				continue
+			}
+			if err := c.releasePod(ps, pod); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		// Orphan pod, adopt it if it matches and neither of them is
+		// going away.
+		if !matches || ps.DeletionTimestamp != nil || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if err := canAdopt(); err != nil {
+			// the PodSet changed, don't adopt anything
+			errs = append(errs, err)
+			continue
+		}
+		if err := c.adoptPod(ps, pod); err != nil {
+			if !errors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		claimed = append(claimed, pod)
+	}
+
+	if len(errs) > 0 {
+		return claimed, errs[0]
+	}
+	return claimed, nil
+}
+
+// canAdoptFunc returns a function telling if the PodSet can adopt pods. The
+// cache may lag behind, so the first call fetches the PodSet from the API
+// server to make sure it wasn't deleted, or deleted and recreated under the
+// same name.
+func (c *podSetController) canAdoptFunc(ps *v1alpha1.PodSet) func() error {
+	checked := false
+	var err error
+	return func() error {
+		if checked {
+			return err
+		}
+		checked = true
+
+		fresh, getErr := c.psc.DemoV1alpha1().PodSets(ps.Namespace).Get(ps.Name, metav1.GetOptions{})
+		switch {
+		case getErr != nil:
+			err = getErr
+		case fresh.UID != ps.UID:
+			err = fmt.Errorf("original podset '%s/%s' is gone: got uid %v, wanted %v", ps.Namespace, ps.Name, fresh.UID, ps.UID)
+		case fresh.DeletionTimestamp != nil:
+			err = fmt.Errorf("podset '%s/%s' has just been deleted at %v", ps.Namespace, ps.Name, fresh.DeletionTimestamp)
+		}
+		return err
+	}
+}
+
+// adoptPod sets the PodSet as controller of the pod. The patch fails if the
+// pod was deleted and recreated under the same name.
+func (c *podSetController) adoptPod(ps *v1alpha1.PodSet, pod *corev1.Pod) error {
+	ownerRef := metav1.NewControllerRef(ps, v1alpha1.SchemeGroupVersion.WithKind("PodSet"))
+	patch := fmt.Sprintf(`{"metadata":{"ownerReferences":[{"apiVersion":"%s","kind":"%s","name":"%s","uid":"%s","controller":true,"blockOwnerDeletion":true}],"uid":"%s"}}`,
+		ownerRef.APIVersion, ownerRef.Kind, ps.Name, ps.UID, pod.UID)
+	_, err := c.kc.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.StrategicMergePatchType, []byte(patch))
+	if err == nil {
+		podSetLogger(ps.Namespace, ps.Name).V(2).Info("Adopted pod", "pod", pod.Name)
+	}
+	return err
+}
+
+// releasePod removes the owner reference of the PodSet from the pod.
+func (c *podSetController) releasePod(ps *v1alpha1.PodSet, pod *corev1.Pod) error {
+	patch := fmt.Sprintf(`{"metadata":{"ownerReferences":[{"$patch":"delete","uid":"%s"}],"uid":"%s"}}`, ps.UID, pod.UID)
+	_, err := c.kc.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.StrategicMergePatchType, []byte(patch))
+	if err != nil {
+		// The pod is already gone, or being deleted and its owner
+		// references can't change anymore, either way it's released.
+		if errors.IsNotFound(err) || errors.IsInvalid(err) {
+			return nil
+		}
+		return err
+	}
+	podSetLogger(ps.Namespace, ps.Name).V(2).Info("Released pod", "pod", pod.Name)
+	return nil
+}
+
+// podSetsForOrphan returns the PodSets owned by this instance whose selector
+// matches the orphan pod, they may adopt it.
+func (c *podSetController) podSetsForOrphan(pod metav1.Object) []*v1alpha1.PodSet {
+	nc, err := c.cacheFor(pod.GetNamespace())
+	if err != nil {
+		return nil
+	}
+	podSets, err := nc.psLister.PodSets(pod.GetNamespace()).List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+
+	matching := []*v1alpha1.PodSet{}
+	for _, ps := range podSets {
+		selector, err := podSetSelector(ps)
+		if err != nil || !selector.Matches(labels.Set(pod.GetLabels())) || !c.sharding.owns(ps) {
+			continue
+		}
+		matching = append(matching, ps)
+	}
+	return matching
+}
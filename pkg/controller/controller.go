@@ -2,80 +2,168 @@ package controller
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/hrishin/podset-operator/pkg/apis/demo/v1alpha1"
 	"github.com/hrishin/podset-operator/pkg/client/clientset/versioned"
 	psinformers "github.com/hrishin/podset-operator/pkg/client/informers/externalversions/demo/v1alpha1"
-	pslister "github.com/hrishin/podset-operator/pkg/client/listers/demo/v1alpha1"
+	"github.com/hrishin/podset-operator/pkg/logging"
+	"golang.org/x/time/rate"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	appsinformers "k8s.io/client-go/informers/apps/v1"
 	podinformers "k8s.io/client-go/informers/core/v1"
 	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	podlister "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/client-go/util/workqueue"
 )
 
 const (
 	APP_LABEL = "app"
+
+	// controllerAgentName is the source of the events recorded by the
+	// controller.
+	controllerAgentName = "podset-controller"
+
+	// reasons of the events recorded by the controller, the same as the
+	// upstream ReplicaSet and Deployment controllers
+	successfulCreateReason   = "SuccessfulCreate"
+	successfulDeleteReason   = "SuccessfulDelete"
+	scalingReplicaSetReason  = "ScalingReplicaSet"
+	failedUpdateStatusReason = "FailedUpdateStatus"
+
+	// controllerUIDIndex is the name of the pod informer index keyed by the
+	// UID of the pod's controller.
+	controllerUIDIndex = "controllerUID"
+
+	// slowStartInitialBatchSize is the size of the first batch of pod
+	// creations, following batches double in size.
+	slowStartInitialBatchSize = 1
+
+	// overall rate limit of the workqueue, the same as the default
+	// controller rate limiter
+	workqueueQPS   = 10
+	workqueueBurst = 100
 )
 
 type podSetController struct {
-	kc           k8s.Interface
-	psc          versioned.Interface
-	podLister    podlister.PodLister
-	podHasSynced cache.InformerSynced
-	psLister     pslister.PodSetLister
-	psHasSynced  cache.InformerSynced
+	kc  k8s.Interface
+	psc versioned.Interface
+	// caches of the watched namespaces, keyed by namespace or by
+	// metav1.NamespaceAll when watching all of them
+	caches       map[string]*namespaceCache
+	sharding     Sharding
+	nodeLister   podlister.NodeLister
 	workqueue    workqueue.RateLimitingInterface
-	ns           string
+	expectations *expectations
+	backoff      *creationBackoff
+	recorder     record.EventRecorder
+	activity     *workerActivity
+
+	lock sync.Mutex
+	// synced is set once the informer caches are synced
+	synced bool
 }
 
+// New returns a controller watching the PodSets and their pods through the
+// informers of each namespace. The node informer is optional, without it
+// the ZoneBalanced scale down policy can't tell the zones apart. Only the
+// PodSets selected by the sharding are synced.
 func New(kc k8s.Interface,
 	pc versioned.Interface,
-	podInformer podinformers.PodInformer,
-	psInformer psinformers.PodSetInformer) *podSetController {
+	informers []NamespaceInformers,
+	nodeInformer podinformers.NodeInformer,
+	rateLimiter workqueue.RateLimiter,
+	sharding Sharding) *podSetController {
 
 	psc := &podSetController{
 		kc:           kc,
 		psc:          pc,
-		podLister:    podInformer.Lister(),
-		podHasSynced: podInformer.Informer().HasSynced,
-		psLister:     psInformer.Lister(),
-		psHasSynced:  psInformer.Informer().HasSynced,
-		workqueue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "PodSets"),
+		caches:       map[string]*namespaceCache{},
+		sharding:     sharding,
+		workqueue:    workqueue.NewNamedRateLimitingQueue(rateLimiter, "PodSets"),
+		expectations: newExpectations(),
+		backoff:      newCreationBackoff(),
+		activity:     newWorkerActivity(),
+	}
+
+	// record events on the PodSets, visible with kubectl describe
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(func(format string, args ...interface{}) {
+		logging.V(4).Info(fmt.Sprintf(format, args...))
+	})
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kc.CoreV1().Events("")})
+	psc.recorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
+
+	// nodes are only used to spread pods across zones on scale down
+	if nodeInformer != nil {
+		psc.nodeLister = nodeInformer.Lister()
+	}
+
+	for _, nsInformers := range informers {
+		psc.caches[nsInformers.Namespace] = newNamespaceCache(nsInformers)
+		psc.addEventHandlers(nsInformers.Pods, nsInformers.PodSets, nsInformers.ControllerRevisions)
 	}
 
+	return psc
+}
+
+// addEventHandlers indexes the pods and revisions of a namespace and watches
+// its resources.
+func (c *podSetController) addEventHandlers(podInformer podinformers.PodInformer,
+	psInformer psinformers.PodSetInformer,
+	crInformer appsinformers.ControllerRevisionInformer) {
+
+	// index pods by their controller so a PodSet can find its own pods
+	// without scanning every pod in the cluster
+	err := podInformer.Informer().AddIndexers(cache.Indexers{
+		controllerUIDIndex: controllerUIDIndexFunc,
+	})
+	utilruntime.Must(err)
+	// same for the revisions of the PodSet templates
+	err = crInformer.Informer().AddIndexers(cache.Indexers{
+		controllerUIDIndex: controllerUIDIndexFunc,
+	})
+	utilruntime.Must(err)
+
 	// watch the PodSet resources events
 	// Primary resource
 	psInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: psc.enqueuePodSet,
+		AddFunc: c.enqueuePodSet,
 		UpdateFunc: func(old, new interface{}) {
-			psc.enqueuePodSet(new)
+			c.enqueuePodSet(new)
 		},
+		DeleteFunc: c.deletePodSet,
 	})
 
 	// watch the Pod resources events
 	// Secondary resource
 	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: psc.handlePodObject,
-		UpdateFunc: func(old, new interface{}) {
-			newDepl := new.(*corev1.Pod)
-			oldDepl := old.(*corev1.Pod)
-			if newDepl.ResourceVersion == oldDepl.ResourceVersion {
-				return
-			}
-			psc.handlePodObject(new)
-		},
-		DeleteFunc: psc.handlePodObject,
+		AddFunc:    c.addPod,
+		UpdateFunc: c.updatePod,
+		DeleteFunc: c.deletePod,
 	})
+}
 
-	return psc
+// NewRateLimiter returns a workqueue rate limiter which retries a failing
+// PodSet after an exponential delay from baseDelay to maxDelay, and limits
+// the overall rate like the default controller rate limiter.
+func NewRateLimiter(baseDelay, maxDelay time.Duration) workqueue.RateLimiter {
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(baseDelay, maxDelay),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(workqueueQPS), workqueueBurst)},
+	)
 }
 
 // enqueuePodSet adds objects to workqueue
@@ -89,46 +177,192 @@ func (c *podSetController) enqueuePodSet(obj interface{}) {
 	c.workqueue.Add(key)
 }
 
-// enqueuePodSet adds objects to workqueue
-func (c *podSetController) handlePodObject(obj interface{}) {
-	var object metav1.Object
-	var ok bool
-	if object, ok = obj.(metav1.Object); !ok {
-		_, ok := obj.(cache.DeletedFinalStateUnknown)
+// deletePodSet drops the state kept for a deleted PodSet.
+func (c *podSetController) deletePodSet(obj interface{}) {
+	ps, ok := obj.(*v1alpha1.PodSet)
+	if !ok {
+		// The informer may have missed the deletion, in which case it
+		// hands over the last known state of the PodSet.
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
 		if !ok {
 			utilruntime.HandleError(fmt.Errorf("error decoding object, invalid type"))
 			return
 		}
+		ps, ok = tombstone.Obj.(*v1alpha1.PodSet)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("error decoding object tombstone, invalid type"))
+			return
+		}
+	}
+
+	key, err := cache.MetaNamespaceKeyFunc(ps)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.forgetPodSet(key)
+	// A sync running concurrently may record state again, the sync of
+	// the key cleans it up once the PodSet is gone from the cache.
+	c.workqueue.Add(key)
+}
+
+// forgetPodSet drops the expectations, backoff and metrics of the PodSet
+// with the given key.
+func (c *podSetController) forgetPodSet(key string) {
+	c.expectations.deleteExpectations(key)
+	c.backoff.forget(key)
+	if namespace, name, err := cache.SplitMetaNamespaceKey(key); err == nil {
+		deletePodSetMetrics(namespace, name)
+	}
+}
+
+// addPod lowers the creations expected by the PodSet controlling the pod
+// and enqueues it. An orphan pod enqueues the PodSets which may adopt it.
+func (c *podSetController) addPod(obj interface{}) {
+	pod := obj.(*corev1.Pod)
+
+	controllerRef := metav1.GetControllerOf(pod)
+	if controllerRef == nil {
+		for _, ps := range c.podSetsForOrphan(pod) {
+			c.enqueuePodSet(ps)
+		}
+		return
 	}
+	ps := c.resolveControllerRef(pod.Namespace, controllerRef)
+	if ps == nil {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(ps)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.expectations.creationObserved(key)
+	c.workqueue.Add(key)
+}
 
-	if ownerRef := metav1.GetControllerOf(object); ownerRef != nil {
-		// If this object is not owned by a PodSet, we should not do anything more
-		// with it.
-		if ownerRef.Kind != "PodSet" {
+// updatePod enqueues the PodSet of the pod. A pod which just got a deletion
+// timestamp counts as deleted, like in the upstream ReplicaSet controller,
+// so that its replacement doesn't wait for its grace period.
+func (c *podSetController) updatePod(old, new interface{}) {
+	oldPod := old.(*corev1.Pod)
+	newPod := new.(*corev1.Pod)
+	if newPod.ResourceVersion == oldPod.ResourceVersion {
+		return
+	}
+	if newPod.DeletionTimestamp != nil && oldPod.DeletionTimestamp == nil {
+		c.deletePod(newPod)
+		return
+	}
+	c.handlePodObject(newPod)
+}
+
+// deletePod lowers the deletions expected by the PodSet controlling the pod
+// and enqueues it.
+func (c *podSetController) deletePod(obj interface{}) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		// The informer may have missed the deletion, in which case it
+		// hands over the last known state of the pod.
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("error decoding object, invalid type"))
+			return
+		}
+		pod, ok = tombstone.Obj.(*corev1.Pod)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("error decoding object tombstone, invalid type"))
 			return
 		}
+	}
 
-		ps, err := c.psLister.PodSets(object.GetNamespace()).Get(ownerRef.Name)
-		if err != nil {
-			fmt.Printf("ignoring orphaned object '%s' of podset '%s' \n", object.GetSelfLink(), ownerRef.Name)
+	ps := c.resolveControllerRef(pod.Namespace, metav1.GetControllerOf(pod))
+	if ps == nil {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(ps)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.expectations.deletionObserved(key, pod.UID)
+	c.workqueue.Add(key)
+}
+
+// handlePodObject enqueues the PodSet controlling the pod, or the PodSets
+// which may adopt it if it's an orphan.
+func (c *podSetController) handlePodObject(obj interface{}) {
+	var object metav1.Object
+	var ok bool
+	if object, ok = obj.(metav1.Object); !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("error decoding object, invalid type"))
+			return
+		}
+		object, ok = tombstone.Obj.(metav1.Object)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("error decoding object tombstone, invalid type"))
 			return
 		}
+	}
 
-		c.enqueuePodSet(ps)
+	controllerRef := metav1.GetControllerOf(object)
+	if controllerRef == nil {
+		for _, ps := range c.podSetsForOrphan(object) {
+			c.enqueuePodSet(ps)
+		}
 		return
 	}
+	if ps := c.resolveControllerRef(object.GetNamespace(), controllerRef); ps != nil {
+		c.enqueuePodSet(ps)
+	}
+}
+
+// resolveControllerRef returns the PodSet referenced by a controller owner
+// reference, or nil if the reference doesn't point to an existing PodSet
+// owned by this instance.
+func (c *podSetController) resolveControllerRef(namespace string, ownerRef *metav1.OwnerReference) *v1alpha1.PodSet {
+	// If this object is not owned by a PodSet, we should not do anything more
+	// with it.
+	if ownerRef == nil || ownerRef.Kind != "PodSet" {
+		return nil
+	}
+
+	nc, err := c.cacheFor(namespace)
+	if err != nil {
+		return nil
+	}
+	ps, err := nc.psLister.PodSets(namespace).Get(ownerRef.Name)
+	if err != nil {
+		logging.V(4).Info("Ignoring orphaned object", "podset", ownerRef.Name, "namespace", namespace)
+		return nil
+	}
+	// The PodSet was deleted and recreated with the same name, the object
+	// belongs to the old one.
+	if ps.UID != ownerRef.UID {
+		return nil
+	}
+	if !c.sharding.owns(ps) {
+		return nil
+	}
+
+	return ps
 }
 
 func (c *podSetController) Run(threads int, stopCh <-chan struct{}) error {
 	defer utilruntime.HandleCrash()
 	defer c.workqueue.ShutDown()
 
-	fmt.Println("Starting podset controller")
+	logging.Info("Starting podset controller")
 
 	// sync informer caches
-	if ok := cache.WaitForCacheSync(stopCh, c.podHasSynced, c.psHasSynced); !ok {
+	if ok := cache.WaitForCacheSync(stopCh, c.cachesSynced()...); !ok {
 		return fmt.Errorf("Failed sync the caches")
 	}
+	c.lock.Lock()
+	c.synced = true
+	c.lock.Unlock()
 
 	// start worker to process workqueue items
 	for i := 0; i < threads; i++ {
@@ -165,6 +399,8 @@ func (c *podSetController) processNextWorkItem() bool {
 		// put back on the workqueue and attempted again after a back-off
 		// period.
 		defer c.workqueue.Done(obj)
+		c.activity.started(obj)
+		defer c.activity.finished(obj)
 		var key string
 		var ok bool
 		// We expect strings to come off the workqueue. These are of the
@@ -183,6 +419,7 @@ func (c *podSetController) processNextWorkItem() bool {
 		// Run the syncHandler, passing it the namespace/name string of the
 		// PodSet resource to be synced.
 		if err := c.eventHandler(key); err != nil {
+			reconcileTotal.WithLabelValues("error").Inc()
 			// Put the item back on the workqueue to handle any transient errors.
 			c.workqueue.AddRateLimited(key)
 			return fmt.Errorf("Error syncing '%s': %s, requeuing", key, err.Error())
@@ -190,7 +427,8 @@ func (c *podSetController) processNextWorkItem() bool {
 		// Finally, if no error occurs we Forget this item so it does not
 		// get queued again until another change happens.
 		c.workqueue.Forget(obj)
-		fmt.Printf("Successfully synced '%s' \n", key)
+		reconcileTotal.WithLabelValues("success").Inc()
+		logging.V(4).Info("Successfully synced", "key", key)
 
 		return nil
 	}(obj)
@@ -213,110 +451,496 @@ func (c *podSetController) eventHandler(key string) error {
 		utilruntime.HandleError(fmt.Errorf("invalid resource key: %s", key))
 		return nil
 	}
+	logger := podSetLogger(namespace, name)
+
+	nc, err := c.cacheFor(namespace)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return nil
+	}
 
 	// Get the PodSet resource with this namespace/name
-	ps, err := c.psLister.PodSets(namespace).Get(name)
+	ps, err := nc.psLister.PodSets(namespace).Get(name)
 	if err != nil {
 		// The PodSet resource may no longer exist, in which case we stop
 		// processing.
 		if errors.IsNotFound(err) {
-			utilruntime.HandleError(fmt.Errorf("Podset '%s' in work queue no longer exists", key))
+			c.forgetPodSet(key)
+			logger.V(2).Info("PodSet in work queue no longer exists")
 			return nil
 		}
 
 		return err
 	}
+	// Another instance of the operator syncs the PodSet, e.g. it was
+	// relabelled or the shards changed.
+	if !c.sharding.owns(ps) {
+		logger.V(4).Info("PodSet belongs to another shard, skipping")
+		c.forgetPodSet(key)
+		return nil
+	}
+
+	// Don't scale the PodSet while the cache may still miss pods created
+	// or deleted by a previous sync.
+	podSetNeedsSync := c.expectations.satisfiedExpectations(key)
+	if !podSetNeedsSync {
+		logger.V(4).Info("Waiting for pending pod creations or deletions to be observed")
+	}
 
-	return c.reconcile(ps)
+	return c.reconcile(ps, podSetNeedsSync)
 }
 
 // reconcile tries to achieve the desired state for PodSet
-func (c *podSetController) reconcile(ps *v1alpha1.PodSet) error {
-	// get the existing pods
-	pods, err := c.podCountByLabel(APP_LABEL, ps.Name)
+func (c *podSetController) reconcile(ps *v1alpha1.PodSet, needsSync bool) error {
+	logger := podSetLogger(ps.Namespace, ps.Name)
+
+	// the PodSet is being deleted and asked for its pods to be deleted in
+	// order first
+	if ps.DeletionTimestamp != nil && hasOrderedTeardownFinalizer(ps) {
+		return c.teardown(ps, needsSync)
+	}
+
+	selector, err := podSetSelector(ps)
+	if err != nil {
+		// The spec is invalid, retrying won't help until the user fixes it.
+		logger.Error(err, "Invalid selector")
+		return c.reportInvalidSelector(ps, err)
+	}
+
+	// restore the template of a previous revision, the update of the
+	// PodSet triggers the rollout
+	if ps.Spec.RollbackTo != nil {
+		return c.rollback(ps)
+	}
+
+	// get the existing pods, adopting the orphans
+	owned, err := c.claimPods(ps, selector)
+	if err != nil {
+		return err
+	}
+	pods := filterActivePods(owned)
+	logger.V(4).Info("Found active pods", "count", len(pods), "desired", ps.Spec.Replicas)
+
+	// record the template as the latest revision
+	hash := computeHash(&ps.Spec.Template)
+	update, revisions, err := c.syncRevisions(ps, hash)
 	if err != nil {
 		return err
 	}
-	existingPods := int32(len(pods))
 
-	// compare it with desired state i.e spec.replicas
+	// terminated pods were replaced, garbage collect them
+	terminated := filterTerminatedPods(owned)
+	replaced, gcErr := c.deleteTerminatedPods(ps, terminated)
+
+	// compare it with desired state i.e spec.replicas and converge
+	var manageErr error
+	// the garbage collector deletes the pods of a deleted PodSet
+	if needsSync && ps.DeletionTimestamp == nil {
+		manageErr = c.manageReplicas(ps, owned)
+	}
+
+	// update the status
+	newStatus := calculateStatus(ps, selector, pods, manageErr)
+	_, oldPods := splitPodsByHash(pods, hash)
+	newStatus.UpdateRevision = update.Name
+	newStatus.CurrentRevision = currentRevision(ps, newStatus, revisions, update, oldPods)
+	newStatus.TerminatedReplicas = int32(len(terminated) - replaced)
+	newStatus.ReplacedReplicas = ps.Status.ReplacedReplicas + int64(replaced)
+	desiredReplicas.WithLabelValues(ps.Namespace, ps.Name).Set(float64(ps.Spec.Replicas))
+	currentReplicas.WithLabelValues(ps.Namespace, ps.Name).Set(float64(newStatus.Replicas))
+	if err := c.updatePodSetStatus(ps, newStatus); err != nil {
+		c.recorder.Eventf(ps, corev1.EventTypeWarning, failedUpdateStatusReason, "Error updating status: %v", err)
+		return err
+	}
+	c.recordPodsFailure(ps, newStatus)
+
+	if err := c.truncateHistory(ps, revisions, update, owned); err != nil {
+		return err
+	}
+
+	// Pods which are ready but not yet available won't trigger another
+	// event when they become available, check back once they should be.
+	if manageErr == nil && ps.Spec.MinReadySeconds > 0 &&
+		newStatus.ReadyReplicas == ps.Spec.Replicas &&
+		newStatus.AvailableReplicas != ps.Spec.Replicas {
+		key, err := cache.MetaNamespaceKeyFunc(ps)
+		if err != nil {
+			return err
+		}
+		c.workqueue.AddAfter(key, time.Duration(ps.Spec.MinReadySeconds)*time.Second)
+	}
+
+	// the creations are backing off, not an error worth the rate limited
+	// requeue
+	if failure, ok := manageErr.(*replicaFailure); ok && failure.retryAfter > 0 {
+		key, err := cache.MetaNamespaceKeyFunc(ps)
+		if err != nil {
+			return err
+		}
+		c.workqueue.AddAfter(key, failure.retryAfter)
+		manageErr = nil
+	}
+
+	if manageErr != nil {
+		return manageErr
+	}
+	return gcErr
+}
+
+// recordPodsFailure records an event when the pods of the PodSet start
+// failing to run, i.e. when the ReplicaFailure condition changes to a pod
+// failure.
+func (c *podSetController) recordPodsFailure(ps *v1alpha1.PodSet, newStatus v1alpha1.PodSetStatus) {
+	cond := getCondition(newStatus, v1alpha1.PodSetReplicaFailure)
+	if cond == nil || (cond.Reason != crashLoopBackOffReason && cond.Reason != imagePullBackOffReason) {
+		return
+	}
+	if old := getCondition(ps.Status, v1alpha1.PodSetReplicaFailure); old != nil && old.Reason == cond.Reason && old.Message == cond.Message {
+		return
+	}
+	c.recorder.Event(ps, corev1.EventTypeWarning, cond.Reason, cond.Message)
+}
+
+// reportInvalidSelector sets the ReplicaFailure condition of a PodSet whose
+// selector is invalid, and records an event when the condition changes.
+func (c *podSetController) reportInvalidSelector(ps *v1alpha1.PodSet, err error) error {
+	message := fmt.Sprintf("Invalid selector: %v", err)
+	if old := getCondition(ps.Status, v1alpha1.PodSetReplicaFailure); old == nil || old.Reason != invalidSelectorReason || old.Message != message {
+		c.recorder.Event(ps, corev1.EventTypeWarning, invalidSelectorReason, message)
+	}
+
+	newStatus := ps.Status.DeepCopy()
+	newStatus.ObservedGeneration = ps.Generation
+	setCondition(newStatus, newCondition(v1alpha1.PodSetReplicaFailure, corev1.ConditionTrue,
+		invalidSelectorReason, message))
+	if err := c.updatePodSetStatus(ps, *newStatus); err != nil {
+		c.recorder.Eventf(ps, corev1.EventTypeWarning, failedUpdateStatusReason, "Error updating status: %v", err)
+		return err
+	}
+	return nil
+}
+
+// updatePodSetStatus writes the status through the status subresource, so
+// the spec is never overwritten. Nothing is written if the status didn't
+// change, and conflicts are retried against a fresh copy of the PodSet.
+func (c *podSetController) updatePodSetStatus(ps *v1alpha1.PodSet, newStatus v1alpha1.PodSetStatus) error {
+	if equality.Semantic.DeepEqual(ps.Status, newStatus) {
+		return nil
+	}
+
+	// The number of replaced pods is a counter, its increment is applied
+	// to the latest status rather than overwriting it.
+	replaced := newStatus.ReplacedReplicas - ps.Status.ReplacedReplicas
+	client := c.psc.DemoV1alpha1().PodSets(ps.Namespace)
+	return c.updatePodSet(ps, client.UpdateStatus, func(latest *v1alpha1.PodSet) bool {
+		status := newStatus.DeepCopy()
+		status.ReplacedReplicas = latest.Status.ReplacedReplicas + replaced
+		if equality.Semantic.DeepEqual(latest.Status, *status) {
+			return false
+		}
+		latest.Status = *status
+		return true
+	})
+}
+
+// updatePodSet applies mutate to a copy of the PodSet and writes it with
+// write. Conflicts are retried by applying mutate to a fresh copy of the
+// PodSet, and nothing is written once mutate returns false.
+func (c *podSetController) updatePodSet(ps *v1alpha1.PodSet,
+	write func(*v1alpha1.PodSet) (*v1alpha1.PodSet, error), mutate func(*v1alpha1.PodSet) bool) error {
+
+	client := c.psc.DemoV1alpha1().PodSets(ps.Namespace)
+	psCopy := ps.DeepCopy()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if !mutate(psCopy) {
+			return nil
+		}
+		_, err := write(psCopy)
+		if !errors.IsConflict(err) {
+			return err
+		}
+
+		// The cached copy is stale, fetch the latest one and try again.
+		latest, getErr := client.Get(ps.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		psCopy = latest.DeepCopy()
+		return err
+	})
+}
+
+// manageReplicas creates or deletes pods until the PodSet has as many active
+// pods as spec.replicas asks for, all of them running the current template.
+func (c *podSetController) manageReplicas(ps *v1alpha1.PodSet, owned []*corev1.Pod) error {
+	hash := computeHash(&ps.Spec.Template)
+	pods := filterActivePods(owned)
+	newPods, oldPods := splitPodsByHash(pods, hash)
+
+	// the template changed, replace the old pods according to the strategy
+	switch ps.Spec.Strategy.Type {
+	case v1alpha1.RecreatePodSetStrategyType:
+		// kill all the old pods and wait for them to be gone before
+		// creating new ones
+		if len(oldPods) > 0 {
+			return c.deletePods(ps, oldPods)
+		}
+		if oldPodsRunning(owned, hash) {
+			return nil
+		}
+	default:
+		if len(oldPods) > 0 {
+			return c.rolloutRolling(ps, newPods, oldPods)
+		}
+	}
+
+	diff := len(pods) - int(ps.Spec.Replicas)
 	// if less then spin up pods
-	if existingPods < ps.Spec.Replicas {
-		pod := newPod(ps)
-		_, err := c.kc.CoreV1().
-			Pods(ps.Namespace).
-			Create(pod)
+	if diff < 0 {
+		key, err := cache.MetaNamespaceKeyFunc(ps)
 		if err != nil {
 			return err
 		}
+		// don't report a scale up the backoff skips
+		if failure := c.backoff.inBackoff(key); failure != nil {
+			return failure
+		}
+		c.recorder.Eventf(ps, corev1.EventTypeNormal, scalingReplicaSetReason, "Scaled up podset %s to %d", ps.Name, ps.Spec.Replicas)
+		return c.createPods(ps, -diff)
 	}
 	// if more then delete the pods
-	if diff := existingPods - ps.Spec.Replicas; diff > 0 {
-		pod := pods[0]
-		err := c.kc.CoreV1().
+	if diff > 0 {
+		c.recorder.Eventf(ps, corev1.EventTypeNormal, scalingReplicaSetReason, "Scaled down podset %s to %d", ps.Name, ps.Spec.Replicas)
+		return c.deletePods(ps, c.podsToDelete(ps, pods, diff))
+	}
+
+	return nil
+}
+
+// createPods creates count pods from the PodSet's template.
+func (c *podSetController) createPods(ps *v1alpha1.PodSet, count int) error {
+	key, err := cache.MetaNamespaceKeyFunc(ps)
+	if err != nil {
+		return err
+	}
+
+	// a previous creation failed, give the cause (quota, admission, ...)
+	// some time to go away
+	if failure := c.backoff.inBackoff(key); failure != nil {
+		return failure
+	}
+
+	// Expect the creations before issuing them, the informer may
+	// observe the pods before the calls return.
+	c.expectations.expectCreations(key, count)
+	// Create the pods in batches of doubling size so that a PodSet which
+	// can't create pods (e.g. quota exceeded) fails after a handful of
+	// calls instead of flooding the API server.
+	successful, err := slowStartBatch(count, slowStartInitialBatchSize, func() error {
+		pod, err := c.kc.CoreV1().
 			Pods(ps.Namespace).
-			Delete(pod, &metav1.DeleteOptions{})
+			Create(newPod(ps))
 		if err != nil {
 			return err
 		}
+		podCreationsTotal.WithLabelValues(ps.Namespace).Inc()
+		c.recorder.Eventf(ps, corev1.EventTypeNormal, successfulCreateReason, "Created pod: %v", pod.Name)
+		return nil
+	})
+	if skipped := count - successful; skipped > 0 {
+		// The skipped and failed pods will never be observed.
+		c.expectations.lowerExpectations(key, skipped)
+		podSetLogger(ps.Namespace, ps.Name).Info("Slow-start failure, skipped pod creations", "skipped", skipped)
+	}
+	if err != nil {
+		failure := newCreateFailure(err)
+		c.backoff.failed(key, failure)
+		c.recorder.Eventf(ps, corev1.EventTypeWarning, failedCreateReason, "Error creating: %v", err)
+		return failure
 	}
 
-	// update the status (status.availablereplicas)
-	psCopy := ps.DeepCopy()
-	psCopy.Status.AvailableReplicas = existingPods
-	_, err = c.psc.DemoV1alpha1().
-		PodSets(psCopy.Namespace).
-		Update(psCopy)
+	c.backoff.succeeded(key)
+	return nil
+}
+
+// deletePods deletes the given pods of the PodSet in parallel.
+func (c *podSetController) deletePods(ps *v1alpha1.PodSet, pods []*corev1.Pod) error {
+	return c.deletePodsWithOptions(ps, pods, &metav1.DeleteOptions{})
+}
+
+// deletePodsWithOptions deletes the given pods of the PodSet in parallel with
+// the given options.
+func (c *podSetController) deletePodsWithOptions(ps *v1alpha1.PodSet, pods []*corev1.Pod, options *metav1.DeleteOptions) error {
+	key, err := cache.MetaNamespaceKeyFunc(ps)
 	if err != nil {
 		return err
 	}
 
+	c.expectations.expectDeletions(key, pods)
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(pods))
+	wg.Add(len(pods))
+	for _, pod := range pods {
+		go func(pod *corev1.Pod) {
+			defer wg.Done()
+			err := c.kc.CoreV1().
+				Pods(ps.Namespace).
+				Delete(pod.Name, options)
+			if err != nil {
+				// The deletion will never be observed.
+				c.expectations.deletionObserved(key, pod.UID)
+				if !errors.IsNotFound(err) {
+					c.recorder.Eventf(ps, corev1.EventTypeWarning, failedDeleteReason, "Error deleting: %v", err)
+					errCh <- err
+				}
+				return
+			}
+			podDeletionsTotal.WithLabelValues(ps.Namespace).Inc()
+			c.recorder.Eventf(ps, corev1.EventTypeNormal, successfulDeleteReason, "Deleted pod: %v", pod.Name)
+		}(pod)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		return &replicaFailure{reason: failedDeleteReason, message: err.Error()}
+	default:
+	}
+
 	return nil
 }
 
-func (c *podSetController) podCountByLabel(key, value string) ([]string, error) {
-	pNames := []string{}
+// slowStartBatch calls fn count times, in batches which start with
+// initialBatchSize calls and double on every successful batch. The calls
+// within a batch run in parallel. It stops at the first batch with an error
+// and returns the number of successful calls.
+func slowStartBatch(count int, initialBatchSize int, fn func() error) (int, error) {
+	remaining := count
+	successes := 0
+	for batchSize := integerMin(remaining, initialBatchSize); batchSize > 0; batchSize = integerMin(2*batchSize, remaining) {
+		errCh := make(chan error, batchSize)
+		var wg sync.WaitGroup
+		wg.Add(batchSize)
+		for i := 0; i < batchSize; i++ {
+			go func() {
+				defer wg.Done()
+				if err := fn(); err != nil {
+					errCh <- err
+				}
+			}()
+		}
+		wg.Wait()
 
-	lbls := labels.Set{
-		key: value,
+		curSuccesses := batchSize - len(errCh)
+		successes += curSuccesses
+		if len(errCh) > 0 {
+			return successes, <-errCh
+		}
+		remaining -= batchSize
 	}
-	pods, err := c.podLister.List(labels.SelectorFromSet(lbls))
-	if err != nil {
-		return pNames, fmt.Errorf("Error in retriving pods\n")
+
+	return successes, nil
+}
+
+func integerMin(a, b int) int {
+	if a < b {
+		return a
 	}
+	return b
+}
 
+// filterActivePods returns the Pending and Running pods which aren't being
+// deleted.
+func filterActivePods(pods []*corev1.Pod) []*corev1.Pod {
+	active := []*corev1.Pod{}
 	for _, p := range pods {
+		if p.DeletionTimestamp != nil {
+			continue
+		}
 		if p.Status.Phase == corev1.PodPending || p.Status.Phase == corev1.PodRunning {
-			pNames = append(pNames, p.Name)
+			active = append(active, p)
 		}
 	}
 
-	fmt.Printf("count : %d \n", len(pNames))
+	return active
+}
 
-	return pNames, nil
+// controllerUIDIndexFunc indexes objects by the UID of their controller owner
+// reference, objects without a controller aren't indexed.
+func controllerUIDIndexFunc(obj interface{}) ([]string, error) {
+	object, ok := obj.(metav1.Object)
+	if !ok {
+		return nil, nil
+	}
+	ownerRef := metav1.GetControllerOf(object)
+	if ownerRef == nil {
+		return nil, nil
+	}
+
+	return []string{string(ownerRef.UID)}, nil
 }
 
-func newPod(ps *v1alpha1.PodSet) *corev1.Pod {
-	labels := map[string]string{
-		APP_LABEL: ps.Name,
+// podSetLogger returns a logger adding the PodSet to every line.
+func podSetLogger(namespace, name string) logging.Logger {
+	return logging.WithValues("podset", name, "namespace", namespace)
+}
+
+// podSetSelector returns the selector of the PodSet, defaulting to the
+// app=<name> label, and makes sure it matches the labels of the template.
+func podSetSelector(ps *v1alpha1.PodSet) (labels.Selector, error) {
+	if ps.Spec.Selector == nil {
+		return labels.SelectorFromSet(labels.Set{APP_LABEL: ps.Name}), nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(ps.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	if selector.Empty() {
+		return nil, fmt.Errorf("empty selector is not allowed")
+	}
+	if !selector.Matches(labels.Set(ps.Spec.Template.Labels)) {
+		return nil, fmt.Errorf("selector does not match template labels")
+	}
+
+	return selector, nil
+}
+
+// podLabels returns the labels for pods of the PodSet, i.e. the template
+// labels plus the ones owned by the controller. The app label is only set
+// for the default selector, an explicit selector matches the template labels
+// as they are.
+func podLabels(ps *v1alpha1.PodSet) map[string]string {
+	labels := map[string]string{}
+	for k, v := range ps.Spec.Template.Labels {
+		labels[k] = v
+	}
+	if ps.Spec.Selector == nil {
+		labels[APP_LABEL] = ps.Name
 	}
+	labels[podSetNameLabel] = ps.Name
+	labels[podTemplateHashLabel] = computeHash(&ps.Spec.Template)
+
+	return labels
+}
+
+// newPod stamps out a pod from the PodSet's template, adding the labels and
+// owner reference the controller relies on to find the pods it manages.
+func newPod(ps *v1alpha1.PodSet) *corev1.Pod {
+	template := ps.Spec.Template.DeepCopy()
+
 	return &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			GenerateName: ps.Name + "-pod",
 			Namespace:    ps.Namespace,
-			Labels:       labels,
+			Labels:       podLabels(ps),
+			Annotations:  template.Annotations,
+			Finalizers:   template.Finalizers,
 			OwnerReferences: []metav1.OwnerReference{
 				*metav1.NewControllerRef(ps, v1alpha1.SchemeGroupVersion.WithKind("PodSet")),
 			},
 		},
-		Spec: corev1.PodSpec{
-			Containers: []corev1.Container{
-				{
-					Name:    "busybox",
-					Image:   "busybox",
-					Command: []string{"sleep", "3600"},
-				},
-			},
-		},
+		Spec: template.Spec,
 	}
 }
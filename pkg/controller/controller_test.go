@@ -0,0 +1,646 @@
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hrishin/podset-operator/pkg/apis/demo/v1alpha1"
+	psfake "github.com/hrishin/podset-operator/pkg/client/clientset/versioned/fake"
+	psinformers "github.com/hrishin/podset-operator/pkg/client/informers/externalversions"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const testPodSetKey = "default/web"
+
+func newTestPodSet() *v1alpha1.PodSet {
+	return &v1alpha1.PodSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "ps-uid"},
+		Spec: v1alpha1.PodSetSpec{
+			Replicas: 1,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+			},
+		},
+	}
+}
+
+// newTestPod returns a pod of the PodSet, an orphan one if ps is nil.
+func newTestPod(ps *v1alpha1.PodSet) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-1",
+			Namespace: "default",
+			UID:       "pod-uid",
+			Labels:    map[string]string{"app": "web", podSetNameLabel: "web"},
+		},
+	}
+	if ps != nil {
+		pod.OwnerReferences = []metav1.OwnerReference{
+			*metav1.NewControllerRef(ps, v1alpha1.SchemeGroupVersion.WithKind("PodSet")),
+		}
+	}
+	return pod
+}
+
+// newTestController returns a controller watching every namespace, whose
+// caches and API server hold the given PodSets.
+func newTestController(t *testing.T, podSets ...*v1alpha1.PodSet) *podSetController {
+	objs := []kruntime.Object{}
+	for _, ps := range podSets {
+		objs = append(objs, ps)
+	}
+	kc := fake.NewSimpleClientset()
+	pc := psfake.NewSimpleClientset(objs...)
+	k8sInformerFactory := kubeinformers.NewSharedInformerFactory(kc, 0)
+	psInformerFactory := psinformers.NewSharedInformerFactory(pc, 0)
+	informers := NamespaceInformers{
+		Namespace:           metav1.NamespaceAll,
+		Pods:                NewPodInformer(k8sInformerFactory, metav1.NamespaceAll),
+		PodSets:             psInformerFactory.Demo().V1alpha1().PodSets(),
+		ControllerRevisions: k8sInformerFactory.Apps().V1().ControllerRevisions(),
+	}
+
+	c := New(kc, pc, []NamespaceInformers{informers}, nil, workqueue.DefaultControllerRateLimiter(), Sharding{})
+	for _, ps := range podSets {
+		if err := informers.PodSets.Informer().GetIndexer().Add(ps); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	return c
+}
+
+// queuedKeys drains the workqueue of the controller.
+func queuedKeys(c *podSetController) []string {
+	keys := []string{}
+	for c.workqueue.Len() > 0 {
+		key, _ := c.workqueue.Get()
+		keys = append(keys, key.(string))
+		c.workqueue.Done(key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestDeletePodSet(t *testing.T) {
+	ps := newTestPodSet()
+
+	tests := []struct {
+		name          string
+		obj           interface{}
+		wantQueued    []string
+		wantForgotten bool
+	}{
+		{
+			name:          "podset",
+			obj:           ps,
+			wantQueued:    []string{testPodSetKey},
+			wantForgotten: true,
+		},
+		{
+			name:          "tombstone of a podset",
+			obj:           cache.DeletedFinalStateUnknown{Key: testPodSetKey, Obj: ps},
+			wantQueued:    []string{testPodSetKey},
+			wantForgotten: true,
+		},
+		{
+			name:       "tombstone of a pod",
+			obj:        cache.DeletedFinalStateUnknown{Key: "default/web-1", Obj: newTestPod(ps)},
+			wantQueued: []string{},
+		},
+		{
+			name:       "invalid object",
+			obj:        "default/web",
+			wantQueued: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t)
+			c.expectations.expectCreations(testPodSetKey, 1)
+			c.backoff.failed(testPodSetKey, &replicaFailure{reason: failedCreateReason})
+			desiredReplicas.WithLabelValues("default", "web").Set(1)
+			currentReplicas.WithLabelValues("default", "web").Set(0)
+
+			c.deletePodSet(tt.obj)
+
+			if got := queuedKeys(c); !reflect.DeepEqual(got, tt.wantQueued) {
+				t.Errorf("queued keys = %v, want %v", got, tt.wantQueued)
+			}
+			_, expecting := c.expectations.get(testPodSetKey)
+			backingOff := c.backoff.inBackoff(testPodSetKey) != nil
+			desired := desiredReplicas.DeleteLabelValues("default", "web")
+			current := currentReplicas.DeleteLabelValues("default", "web")
+			if forgotten := !expecting && !backingOff && !desired && !current; forgotten != tt.wantForgotten {
+				t.Errorf("forgotten = %v (expectations %v, backoff %v, desired gauge %v, current gauge %v), want %v",
+					forgotten, expecting, backingOff, desired, current, tt.wantForgotten)
+			}
+		})
+	}
+}
+
+func TestDeletePod(t *testing.T) {
+	ps := newTestPodSet()
+	recreated := newTestPodSet()
+	recreated.UID = "old-ps-uid"
+	terminated := newTestPod(ps)
+	terminated.Name, terminated.UID = "web-0", "terminated-pod-uid"
+	terminated.Status.Phase = corev1.PodFailed
+
+	tests := []struct {
+		name         string
+		obj          interface{}
+		wantQueued   []string
+		wantObserved bool
+	}{
+		{
+			name:         "pod",
+			obj:          newTestPod(ps),
+			wantQueued:   []string{testPodSetKey},
+			wantObserved: true,
+		},
+		{
+			name:         "tombstone of a pod",
+			obj:          cache.DeletedFinalStateUnknown{Key: "default/web-1", Obj: newTestPod(ps)},
+			wantQueued:   []string{testPodSetKey},
+			wantObserved: true,
+		},
+		{
+			name:       "tombstone of a podset",
+			obj:        cache.DeletedFinalStateUnknown{Key: testPodSetKey, Obj: ps},
+			wantQueued: []string{},
+		},
+		{
+			name:       "invalid object",
+			obj:        "default/web-1",
+			wantQueued: []string{},
+		},
+		{
+			name:       "orphan pod",
+			obj:        newTestPod(nil),
+			wantQueued: []string{},
+		},
+		{
+			name:       "terminated pod garbage collected",
+			obj:        terminated,
+			wantQueued: []string{testPodSetKey},
+		},
+		{
+			name:       "pod of a recreated podset",
+			obj:        newTestPod(recreated),
+			wantQueued: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t, ps)
+			c.expectations.expectDeletions(testPodSetKey, []*corev1.Pod{newTestPod(ps)})
+
+			c.deletePod(tt.obj)
+
+			if got := queuedKeys(c); !reflect.DeepEqual(got, tt.wantQueued) {
+				t.Errorf("queued keys = %v, want %v", got, tt.wantQueued)
+			}
+			if observed := c.expectations.satisfiedExpectations(testPodSetKey); observed != tt.wantObserved {
+				t.Errorf("deletion observed = %v, want %v", observed, tt.wantObserved)
+			}
+		})
+	}
+}
+
+func TestUpdatePod(t *testing.T) {
+	ps := newTestPodSet()
+	now := metav1.Now()
+
+	deleting := func(pod *corev1.Pod) *corev1.Pod {
+		pod.DeletionTimestamp = &now
+		return pod
+	}
+	withVersion := func(pod *corev1.Pod, version string) *corev1.Pod {
+		pod.ResourceVersion = version
+		return pod
+	}
+	other := newTestPod(ps)
+	other.UID = "other-pod-uid"
+
+	tests := []struct {
+		name         string
+		old          *corev1.Pod
+		new          *corev1.Pod
+		wantQueued   []string
+		wantObserved bool
+	}{
+		{
+			name:         "deletion timestamp set",
+			old:          withVersion(newTestPod(ps), "1"),
+			new:          withVersion(deleting(newTestPod(ps)), "2"),
+			wantQueued:   []string{testPodSetKey},
+			wantObserved: true,
+		},
+		{
+			name:       "deletion timestamp already set",
+			old:        withVersion(deleting(newTestPod(ps)), "1"),
+			new:        withVersion(deleting(newTestPod(ps)), "2"),
+			wantQueued: []string{testPodSetKey},
+		},
+		{
+			name:       "deletion timestamp set on an unexpected pod",
+			old:        withVersion(other.DeepCopy(), "1"),
+			new:        withVersion(deleting(other.DeepCopy()), "2"),
+			wantQueued: []string{testPodSetKey},
+		},
+		{
+			name:       "resync",
+			old:        withVersion(newTestPod(ps), "1"),
+			new:        withVersion(deleting(newTestPod(ps)), "1"),
+			wantQueued: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t, ps)
+			c.expectations.expectDeletions(testPodSetKey, []*corev1.Pod{newTestPod(ps)})
+
+			c.updatePod(tt.old, tt.new)
+
+			if got := queuedKeys(c); !reflect.DeepEqual(got, tt.wantQueued) {
+				t.Errorf("queued keys = %v, want %v", got, tt.wantQueued)
+			}
+			if observed := c.expectations.satisfiedExpectations(testPodSetKey); observed != tt.wantObserved {
+				t.Errorf("deletion observed = %v, want %v", observed, tt.wantObserved)
+			}
+		})
+	}
+}
+
+func TestDeletionObservedOnce(t *testing.T) {
+	ps := newTestPodSet()
+	first := newTestPod(ps)
+	second := newTestPod(ps)
+	second.Name, second.UID = "web-2", "pod-uid-2"
+	c := newTestController(t, ps)
+	c.expectations.expectDeletions(testPodSetKey, []*corev1.Pod{first, second})
+
+	deleting := first.DeepCopy()
+	deleting.ResourceVersion = "2"
+	deleting.DeletionTimestamp = &metav1.Time{}
+	c.updatePod(first, deleting)
+	c.deletePod(deleting)
+	if c.expectations.satisfiedExpectations(testPodSetKey) {
+		t.Fatal("expectations satisfied before the second deletion")
+	}
+
+	c.deletePod(second)
+	if !c.expectations.satisfiedExpectations(testPodSetKey) {
+		t.Error("expectations not satisfied after both deletions")
+	}
+}
+
+func TestHandlePodObject(t *testing.T) {
+	ps := newTestPodSet()
+
+	tests := []struct {
+		name       string
+		obj        interface{}
+		wantQueued []string
+	}{
+		{
+			name:       "pod",
+			obj:        newTestPod(ps),
+			wantQueued: []string{testPodSetKey},
+		},
+		{
+			name:       "tombstone of a pod",
+			obj:        cache.DeletedFinalStateUnknown{Key: "default/web-1", Obj: newTestPod(ps)},
+			wantQueued: []string{testPodSetKey},
+		},
+		{
+			name:       "tombstone of an orphan pod",
+			obj:        cache.DeletedFinalStateUnknown{Key: "default/web-1", Obj: newTestPod(nil)},
+			wantQueued: []string{testPodSetKey},
+		},
+		{
+			name:       "invalid tombstone",
+			obj:        cache.DeletedFinalStateUnknown{Key: "default/web-1", Obj: "web-1"},
+			wantQueued: []string{},
+		},
+		{
+			name:       "invalid object",
+			obj:        "default/web-1",
+			wantQueued: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t, ps)
+
+			c.handlePodObject(tt.obj)
+
+			if got := queuedKeys(c); !reflect.DeepEqual(got, tt.wantQueued) {
+				t.Errorf("queued keys = %v, want %v", got, tt.wantQueued)
+			}
+		})
+	}
+}
+
+func TestForgetPodSet(t *testing.T) {
+	c := newTestController(t)
+	c.expectations.setExpectations(testPodSetKey, 2, []types.UID{"pod-uid"})
+	c.backoff.failed(testPodSetKey, &replicaFailure{reason: failedCreateReason})
+	desiredReplicas.WithLabelValues("default", "web").Set(3)
+	currentReplicas.WithLabelValues("default", "web").Set(1)
+
+	c.forgetPodSet(testPodSetKey)
+
+	if _, ok := c.expectations.get(testPodSetKey); ok {
+		t.Error("expectations not deleted")
+	}
+	if failure := c.backoff.inBackoff(testPodSetKey); failure != nil {
+		t.Errorf("still backing off: %v", failure)
+	}
+	if desiredReplicas.DeleteLabelValues("default", "web") {
+		t.Error("desired replicas gauge not deleted")
+	}
+	if currentReplicas.DeleteLabelValues("default", "web") {
+		t.Error("current replicas gauge not deleted")
+	}
+}
+
+func TestReconcileInvalidSelector(t *testing.T) {
+	ps := newTestPodSet()
+	ps.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "other"}}
+	c := newTestController(t, ps)
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+
+	if err := c.reconcile(ps, true); err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+
+	got, err := c.psc.DemoV1alpha1().PodSets(ps.Namespace).Get(ps.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	cond := getCondition(got.Status, v1alpha1.PodSetReplicaFailure)
+	if cond == nil || cond.Reason != invalidSelectorReason {
+		t.Errorf("ReplicaFailure condition = %+v, want reason %s", cond, invalidSelectorReason)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, invalidSelectorReason) {
+			t.Errorf("event = %q, want reason %s", event, invalidSelectorReason)
+		}
+	default:
+		t.Error("no event recorded")
+	}
+}
+
+func TestResolveFenceposts(t *testing.T) {
+	tests := []struct {
+		name            string
+		replicas        int32
+		maxSurge        *intstr.IntOrString
+		maxUnavailable  *intstr.IntOrString
+		wantSurge       int
+		wantUnavailable int
+		wantErr         bool
+	}{
+		{
+			name:            "defaults round surge up and unavailable down",
+			replicas:        10,
+			wantSurge:       3,
+			wantUnavailable: 2,
+		},
+		{
+			name:            "small percentages",
+			replicas:        3,
+			maxSurge:        intOrStringPtr(intstr.FromString("10%")),
+			maxUnavailable:  intOrStringPtr(intstr.FromString("10%")),
+			wantSurge:       1,
+			wantUnavailable: 0,
+		},
+		{
+			name:            "absolute values",
+			replicas:        10,
+			maxSurge:        intOrStringPtr(intstr.FromInt(4)),
+			maxUnavailable:  intOrStringPtr(intstr.FromInt(1)),
+			wantSurge:       4,
+			wantUnavailable: 1,
+		},
+		{
+			name:            "both resolve to 0",
+			replicas:        5,
+			maxSurge:        intOrStringPtr(intstr.FromInt(0)),
+			maxUnavailable:  intOrStringPtr(intstr.FromString("10%")),
+			wantSurge:       0,
+			wantUnavailable: 1,
+		},
+		{
+			name:     "invalid percentage",
+			replicas: 5,
+			maxSurge: intOrStringPtr(intstr.FromString("many")),
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := newTestPodSet()
+			ps.Spec.Replicas = tt.replicas
+			if tt.maxSurge != nil || tt.maxUnavailable != nil {
+				ps.Spec.Strategy.RollingUpdate = &v1alpha1.RollingUpdatePodSet{
+					MaxSurge:       tt.maxSurge,
+					MaxUnavailable: tt.maxUnavailable,
+				}
+			}
+
+			surge, unavailable, err := resolveFenceposts(ps)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveFenceposts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if surge != tt.wantSurge || unavailable != tt.wantUnavailable {
+				t.Errorf("resolveFenceposts() = %d, %d, want %d, %d", surge, unavailable, tt.wantSurge, tt.wantUnavailable)
+			}
+		})
+	}
+}
+
+func TestRolloutRolling(t *testing.T) {
+	tests := []struct {
+		name           string
+		replicas       int32
+		maxSurge       intstr.IntOrString
+		maxUnavailable intstr.IntOrString
+		// pods as name:available, created in that order
+		newPods     []string
+		oldPods     []string
+		wantCreated int
+		wantDeleted []string
+	}{
+		{
+			name:           "surge creates new pods",
+			replicas:       4,
+			maxSurge:       intstr.FromInt(1),
+			maxUnavailable: intstr.FromInt(0),
+			oldPods:        []string{"old-0:true", "old-1:true", "old-2:true", "old-3:true"},
+			wantCreated:    1,
+			wantDeleted:    []string{},
+		},
+		{
+			name:           "percentages rounded",
+			replicas:       10,
+			maxSurge:       intstr.FromString("25%"),
+			maxUnavailable: intstr.FromString("25%"),
+			oldPods: []string{"old-0:true", "old-1:true", "old-2:true", "old-3:true", "old-4:true",
+				"old-5:true", "old-6:true", "old-7:true", "old-8:true", "old-9:true"},
+			wantCreated: 3,
+			wantDeleted: []string{},
+		},
+		{
+			name:           "surge used up by a new pod not yet available",
+			replicas:       4,
+			maxSurge:       intstr.FromInt(1),
+			maxUnavailable: intstr.FromInt(0),
+			newPods:        []string{"new-0:false"},
+			oldPods:        []string{"old-0:true", "old-1:true", "old-2:true", "old-3:true"},
+			wantDeleted:    []string{},
+		},
+		{
+			name:           "available new pod replaces an old one",
+			replicas:       4,
+			maxSurge:       intstr.FromInt(1),
+			maxUnavailable: intstr.FromInt(0),
+			newPods:        []string{"new-0:true"},
+			oldPods:        []string{"old-0:true", "old-1:true", "old-2:true", "old-3:true"},
+			wantDeleted:    []string{"old-3"},
+		},
+		{
+			name:           "unavailable old pods go first",
+			replicas:       4,
+			maxSurge:       intstr.FromInt(0),
+			maxUnavailable: intstr.FromInt(1),
+			oldPods:        []string{"old-0:true", "old-1:false", "old-2:true", "old-3:true"},
+			wantDeleted:    []string{"old-1"},
+		},
+		{
+			name:           "surge and unavailable both 0",
+			replicas:       1,
+			maxSurge:       intstr.FromString("0%"),
+			maxUnavailable: intstr.FromString("10%"),
+			oldPods:        []string{"old-0:true"},
+			wantDeleted:    []string{"old-0"},
+		},
+		{
+			name:           "scaled down mid-rollout",
+			replicas:       2,
+			maxSurge:       intstr.FromInt(1),
+			maxUnavailable: intstr.FromInt(0),
+			newPods:        []string{"new-0:true", "new-1:true", "new-2:true"},
+			oldPods:        []string{"old-0:true"},
+			wantDeleted:    []string{"new-2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := newTestPodSet()
+			ps.Spec.Replicas = tt.replicas
+			ps.Spec.Strategy.RollingUpdate = &v1alpha1.RollingUpdatePodSet{
+				MaxSurge:       &tt.maxSurge,
+				MaxUnavailable: &tt.maxUnavailable,
+			}
+			c := newTestController(t, ps)
+			c.recorder = record.NewFakeRecorder(100)
+			kc := c.kc.(*fake.Clientset)
+			generated := 0
+			kc.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, kruntime.Object, error) {
+				// the fake clientset doesn't generate names
+				pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+				pod.Name = fmt.Sprintf("%s%d", pod.GenerateName, generated)
+				generated++
+				return false, nil, nil
+			})
+
+			hash := computeHash(&ps.Spec.Template)
+			created := 0
+			newPods := rolloutPods(tt.newPods, hash, &created)
+			oldPods := rolloutPods(tt.oldPods, "old", &created)
+
+			if err := c.rolloutRolling(ps, newPods, oldPods); err != nil {
+				t.Fatalf("rolloutRolling() error = %v", err)
+			}
+
+			gotCreated := 0
+			gotDeleted := []string{}
+			for _, action := range kc.Actions() {
+				if action.GetResource().Resource != "pods" {
+					continue
+				}
+				switch a := action.(type) {
+				case k8stesting.CreateAction:
+					gotCreated++
+				case k8stesting.DeleteAction:
+					gotDeleted = append(gotDeleted, a.GetName())
+				}
+			}
+			sort.Strings(gotDeleted)
+			if gotCreated != tt.wantCreated {
+				t.Errorf("created %d pods, want %d", gotCreated, tt.wantCreated)
+			}
+			if !reflect.DeepEqual(gotDeleted, tt.wantDeleted) {
+				t.Errorf("deleted %v, want %v", gotDeleted, tt.wantDeleted)
+			}
+		})
+	}
+}
+
+// rolloutPods returns running pods with the given template hash, from specs
+// of the form name:available. The pods are created one second apart, counted
+// by created.
+func rolloutPods(specs []string, hash string, created *int) []*corev1.Pod {
+	pods := []*corev1.Pod{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              parts[0],
+				Namespace:         "default",
+				UID:               types.UID(parts[0] + "-uid"),
+				Labels:            map[string]string{"app": "web", podTemplateHashLabel: hash},
+				CreationTimestamp: metav1.Unix(int64(*created), 0),
+			},
+			Spec:   corev1.PodSpec{NodeName: "node"},
+			Status: corev1.PodStatus{Phase: corev1.PodRunning},
+		}
+		if parts[1] == "true" {
+			pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+		}
+		*created++
+		pods = append(pods, pod)
+	}
+	return pods
+}
+
+func intOrStringPtr(v intstr.IntOrString) *intstr.IntOrString {
+	return &v
+}
@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// expectationsTimeout is how long the controller waits for the
+	// informer to observe the pods it created or deleted before it syncs
+	// the PodSet anyway. It protects against watch events which are never
+	// delivered.
+	expectationsTimeout = 5 * time.Minute
+)
+
+// expectations tracks, per PodSet key, the number of pod creations and
+// deletions the controller issued but hasn't seen in the informer cache yet.
+// A PodSet whose expectations aren't satisfied must not be scaled again, the
+// cache would report too few (or too many) pods and the controller would
+// over-provision. It is a simplified version of the
+// UIDTrackingControllerExpectations of kube-controller-manager: deletions are
+// tracked by pod UID, so that a pod observed first with a deletion timestamp
+// and then deleted counts once, and the deletions of other pods don't count.
+type expectations struct {
+	cache.Store
+}
+
+// podSetExpectations holds the outstanding creations and deletions of a
+// single PodSet.
+type podSetExpectations struct {
+	add       int64
+	key       string
+	timestamp time.Time
+
+	lock sync.Mutex
+	// UIDs of the pods expected to be deleted
+	deletions map[types.UID]bool
+}
+
+func newExpectations() *expectations {
+	return &expectations{
+		Store: cache.NewStore(expectationsKeyFunc),
+	}
+}
+
+func expectationsKeyFunc(obj interface{}) (string, error) {
+	if e, ok := obj.(*podSetExpectations); ok {
+		return e.key, nil
+	}
+	return "", fmt.Errorf("could not find key for obj %#v", obj)
+}
+
+// get returns the expectations of the PodSet with the given key.
+func (r *expectations) get(key string) (*podSetExpectations, bool) {
+	obj, exists, err := r.GetByKey(key)
+	if err != nil || !exists {
+		return nil, false
+	}
+	return obj.(*podSetExpectations), true
+}
+
+// satisfiedExpectations returns true when the PodSet with the given key can
+// be synced: either all the creations and deletions it expects were observed,
+// the expectations expired, or there are no expectations at all, e.g. after
+// a restart of the controller.
+func (r *expectations) satisfiedExpectations(key string) bool {
+	exp, exists := r.get(key)
+	if !exists {
+		return true
+	}
+	return exp.fulfilled() || exp.isExpired()
+}
+
+// setExpectations overwrites the expectations of the PodSet with the given
+// key.
+func (r *expectations) setExpectations(key string, add int, deletions []types.UID) {
+	exp := &podSetExpectations{
+		add:       int64(add),
+		key:       key,
+		timestamp: time.Now(),
+		deletions: map[types.UID]bool{},
+	}
+	for _, uid := range deletions {
+		exp.deletions[uid] = true
+	}
+	_ = r.Add(exp)
+}
+
+// expectCreations records that adds pods are about to be created.
+func (r *expectations) expectCreations(key string, adds int) {
+	r.setExpectations(key, adds, nil)
+}
+
+// expectDeletions records that the pods are about to be deleted.
+func (r *expectations) expectDeletions(key string, pods []*corev1.Pod) {
+	uids := make([]types.UID, 0, len(pods))
+	for _, p := range pods {
+		uids = append(uids, p.UID)
+	}
+	r.setExpectations(key, 0, uids)
+}
+
+// creationObserved lowers the creations expected by one.
+func (r *expectations) creationObserved(key string) {
+	r.lowerExpectations(key, 1)
+}
+
+// deletionObserved records the deletion of the pod with the given UID, if
+// it was expected.
+func (r *expectations) deletionObserved(key string, uid types.UID) {
+	if exp, exists := r.get(key); exists {
+		exp.lock.Lock()
+		defer exp.lock.Unlock()
+		delete(exp.deletions, uid)
+	}
+}
+
+// lowerExpectations lowers the expected creations of the PodSet with the
+// given key.
+func (r *expectations) lowerExpectations(key string, add int) {
+	if exp, exists := r.get(key); exists {
+		atomic.AddInt64(&exp.add, -int64(add))
+	}
+}
+
+// deleteExpectations forgets the expectations of the PodSet with the given
+// key.
+func (r *expectations) deleteExpectations(key string) {
+	if exp, exists := r.get(key); exists {
+		_ = r.Delete(exp)
+	}
+}
+
+// fulfilled returns true if all the creations and deletions were observed.
+func (e *podSetExpectations) fulfilled() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return atomic.LoadInt64(&e.add) <= 0 && len(e.deletions) == 0
+}
+
+// isExpired returns true if the expectations were set too long ago to be
+// trusted.
+func (e *podSetExpectations) isExpired() bool {
+	return time.Since(e.timestamp) > expectationsTimeout
+}
@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// reasons of the ReplicaFailure condition
+	quotaExceededReason    = "QuotaExceeded"
+	forbiddenReason        = "Forbidden"
+	invalidReason          = "Invalid"
+	crashLoopBackOffReason = "CrashLoopBackOff"
+	imagePullBackOffReason = "ImagePullBackOff"
+
+	// bounds of the per-PodSet backoff applied to pod creation after a
+	// failure
+	createBackoffInitial = 5 * time.Second
+	createBackoffMax     = 5 * time.Minute
+)
+
+// replicaFailure is the error returned when pods of a PodSet can't be created
+// or deleted, classified by reason for the ReplicaFailure condition.
+type replicaFailure struct {
+	reason  string
+	message string
+	// retryAfter is set when the creation was skipped because the PodSet
+	// is backing off from a previous failure.
+	retryAfter time.Duration
+}
+
+func (f *replicaFailure) Error() string {
+	return f.message
+}
+
+// newCreateFailure classifies an error returned by a pod creation.
+func newCreateFailure(err error) *replicaFailure {
+	reason := failedCreateReason
+	switch {
+	case errors.IsForbidden(err) && strings.Contains(err.Error(), "exceeded quota"):
+		reason = quotaExceededReason
+	case errors.IsForbidden(err):
+		reason = forbiddenReason
+	case errors.IsInvalid(err):
+		reason = invalidReason
+	}
+
+	return &replicaFailure{
+		reason:  reason,
+		message: err.Error(),
+	}
+}
+
+// podsFailure returns a failure if one of the pods can't run its containers
+// because they crash in loop or their image can't be pulled, nil otherwise.
+func podsFailure(pods []*corev1.Pod) *replicaFailure {
+	for _, p := range pods {
+		statuses := append([]corev1.ContainerStatus{}, p.Status.InitContainerStatuses...)
+		statuses = append(statuses, p.Status.ContainerStatuses...)
+		for _, cs := range statuses {
+			if cs.State.Waiting == nil {
+				continue
+			}
+
+			reason := ""
+			switch cs.State.Waiting.Reason {
+			case "CrashLoopBackOff":
+				reason = crashLoopBackOffReason
+			case "ImagePullBackOff", "ErrImagePull", "InvalidImageName":
+				reason = imagePullBackOffReason
+			default:
+				continue
+			}
+
+			return &replicaFailure{
+				reason:  reason,
+				message: fmt.Sprintf("pod %s: container %s is waiting: %s", p.Name, cs.Name, cs.State.Waiting.Message),
+			}
+		}
+	}
+
+	return nil
+}
+
+// creationBackoff delays the pod creations of the PodSets whose last creation
+// failed, exponentially with the number of consecutive failures.
+type creationBackoff struct {
+	backoff *flowcontrol.Backoff
+
+	lock     sync.Mutex
+	failures map[string]creationFailure
+}
+
+// creationFailure is the last creation failure of a PodSet.
+type creationFailure struct {
+	failure *replicaFailure
+	at      time.Time
+}
+
+func newCreationBackoff() *creationBackoff {
+	return &creationBackoff{
+		backoff:  flowcontrol.NewBackOff(createBackoffInitial, createBackoffMax),
+		failures: map[string]creationFailure{},
+	}
+}
+
+// failed records a creation failure of the PodSet with the given key.
+func (b *creationBackoff) failed(key string, failure *replicaFailure) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.backoff.Clock.Now()
+	b.backoff.Next(key, now)
+	b.failures[key] = creationFailure{failure: failure, at: now}
+}
+
+// succeeded resets the backoff of the PodSet with the given key.
+func (b *creationBackoff) succeeded(key string) {
+	b.forget(key)
+}
+
+// forget drops the backoff of the PodSet with the given key.
+func (b *creationBackoff) forget(key string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.backoff.DeleteEntry(key)
+	delete(b.failures, key)
+}
+
+// inBackoff returns the last failure of the PodSet with the given key if it
+// must not create pods yet, along with the time left until it may, nil
+// otherwise.
+func (b *creationBackoff) inBackoff(key string) *replicaFailure {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	last, ok := b.failures[key]
+	now := b.backoff.Clock.Now()
+	if !ok || !b.backoff.IsInBackOffSinceUpdate(key, now) {
+		return nil
+	}
+
+	return &replicaFailure{
+		reason:     last.failure.reason,
+		message:    last.failure.message,
+		retryAfter: b.backoff.Get(key) - now.Sub(last.at),
+	}
+}
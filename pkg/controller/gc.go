@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/hrishin/podset-operator/pkg/apis/demo/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// filterTerminatedPods returns the Failed and Succeeded pods which aren't
+// being deleted yet.
+func filterTerminatedPods(pods []*corev1.Pod) []*corev1.Pod {
+	terminated := []*corev1.Pod{}
+	for _, p := range pods {
+		if p.DeletionTimestamp != nil {
+			continue
+		}
+		if p.Status.Phase == corev1.PodFailed || p.Status.Phase == corev1.PodSucceeded {
+			terminated = append(terminated, p)
+		}
+	}
+
+	return terminated
+}
+
+// deleteTerminatedPods deletes the terminated pods of the PodSet, except for
+// the spec.failedPodsHistoryLimit most recent ones kept for debugging. It
+// returns the number of deleted pods.
+//
+// The deletions aren't tracked by the expectations, terminated pods are
+// already replaced and don't count towards the replicas. The expectations
+// only count the deletions of the pods they expect, so these deletions don't
+// satisfy the ones of a scale down in the same sync.
+func (c *podSetController) deleteTerminatedPods(ps *v1alpha1.PodSet, terminated []*corev1.Pod) (int, error) {
+	limit := 0
+	if ps.Spec.FailedPodsHistoryLimit != nil {
+		limit = int(*ps.Spec.FailedPodsHistoryLimit)
+	}
+	if len(terminated) <= limit {
+		return 0, nil
+	}
+
+	// most recently finished first
+	sorted := append([]*corev1.Pod{}, terminated...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ti, tj := podFinishTime(sorted[i]), podFinishTime(sorted[j])
+		return tj.Before(&ti)
+	})
+	victims := sorted[limit:]
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var deleteErr error
+	deleted := 0
+	wg.Add(len(victims))
+	for _, pod := range victims {
+		go func(pod *corev1.Pod) {
+			defer wg.Done()
+			err := c.kc.CoreV1().
+				Pods(ps.Namespace).
+				Delete(pod.Name, &metav1.DeleteOptions{})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				deleted++
+				podDeletionsTotal.WithLabelValues(ps.Namespace).Inc()
+				replacedPodsTotal.WithLabelValues(ps.Namespace).Inc()
+				c.recorder.Eventf(ps, corev1.EventTypeNormal, successfulDeleteReason, "Deleted pod: %v", pod.Name)
+			} else if !errors.IsNotFound(err) {
+				deleteErr = err
+				c.recorder.Eventf(ps, corev1.EventTypeWarning, failedDeleteReason, "Error deleting: %v", err)
+			}
+		}(pod)
+	}
+	wg.Wait()
+
+	return deleted, deleteErr
+}
+
+// podFinishTime returns when the last container of the pod terminated,
+// falling back to its start or creation time.
+func podFinishTime(pod *corev1.Pod) metav1.Time {
+	finish := metav1.Time{}
+	for _, c := range pod.Status.ContainerStatuses {
+		if t := c.State.Terminated; t != nil && finish.Before(&t.FinishedAt) {
+			finish = t.FinishedAt
+		}
+	}
+	if !finish.IsZero() {
+		return finish
+	}
+	if pod.Status.StartTime != nil {
+		return *pod.Status.StartTime
+	}
+	return pod.CreationTimestamp
+}
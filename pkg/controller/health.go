@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// workerActivity tracks the items the workers are processing, so that a
+// worker stuck on an item can be detected.
+type workerActivity struct {
+	lock sync.Mutex
+	// start of the processing of each item, the workqueue never hands the
+	// same item to two workers at once
+	processing map[interface{}]time.Time
+}
+
+func newWorkerActivity() *workerActivity {
+	return &workerActivity{
+		processing: map[interface{}]time.Time{},
+	}
+}
+
+func (a *workerActivity) started(item interface{}) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.processing[item] = time.Now()
+}
+
+func (a *workerActivity) finished(item interface{}) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.processing, item)
+}
+
+// longestRunning returns the item processed for the longest time and since
+// when, ok is false if no item is being processed.
+func (a *workerActivity) longestRunning() (item interface{}, since time.Time, ok bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for i, start := range a.processing {
+		if !ok || start.Before(since) {
+			item, since, ok = i, start, true
+		}
+	}
+	return item, since, ok
+}
+
+// Ready returns an error until the informer caches are synced and the
+// workers started.
+func (c *podSetController) Ready() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.synced {
+		return fmt.Errorf("informer caches not synced")
+	}
+	return nil
+}
+
+// Healthy returns an error if a worker has been processing the same item for
+// longer than timeout.
+func (c *podSetController) Healthy(timeout time.Duration) error {
+	item, since, ok := c.activity.longestRunning()
+	if !ok {
+		return nil
+	}
+	if elapsed := time.Since(since); elapsed > timeout {
+		return fmt.Errorf("worker stuck processing '%v' for %v", item, elapsed.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hrishin/podset-operator/pkg/apis/demo/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// defaultRevisionHistoryLimit is the number of old revisions kept when
+	// spec.revisionHistoryLimit isn't set.
+	defaultRevisionHistoryLimit = 10
+
+	// reasons of the rollback events, the same as the upstream Deployment
+	// controller
+	rollbackDoneReason             = "RollbackDone"
+	rollbackRevisionNotFoundReason = "RollbackRevisionNotFound"
+)
+
+// revisionData is what a ControllerRevision of a PodSet holds: the part of
+// the spec needed to restore its template.
+type revisionData struct {
+	Spec struct {
+		Template corev1.PodTemplateSpec `json:"template"`
+	} `json:"spec"`
+}
+
+// claimRevisions returns the ControllerRevisions controlled by the PodSet,
+// oldest revision first. Like ClaimControllerRevisions of the upstream
+// controllers, it adopts the orphan revisions the PodSet created, e.g.
+// before it was deleted with --cascade=false and created again.
+func (c *podSetController) claimRevisions(ps *v1alpha1.PodSet) ([]*appsv1.ControllerRevision, error) {
+	nc, err := c.cacheFor(ps.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	controlled, err := nc.crIndexer.ByIndex(controllerUIDIndex, string(ps.UID))
+	if err != nil {
+		return nil, fmt.Errorf("Error in retriving controller revisions: %v", err)
+	}
+	namespaced, err := nc.crIndexer.ByIndex(cache.NamespaceIndex, ps.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("Error in retriving controller revisions: %v", err)
+	}
+
+	canAdopt := c.canAdoptFunc(ps)
+	var errs []error
+	revisions := []*appsv1.ControllerRevision{}
+	// the controlled revisions are listed twice
+	seen := map[types.UID]bool{}
+	for _, obj := range append(controlled, namespaced...) {
+		cr, ok := obj.(*appsv1.ControllerRevision)
+		if !ok || cr.Namespace != ps.Namespace || seen[cr.UID] {
+			continue
+		}
+		seen[cr.UID] = true
+
+		if controllerRef := metav1.GetControllerOf(cr); controllerRef != nil {
+			if controllerRef.UID == ps.UID {
+				revisions = append(revisions, cr)
+			}
+			continue
+		}
+		if ps.DeletionTimestamp != nil || !isRevisionOf(ps, cr) {
+			continue
+		}
+		if err := canAdopt(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		adopted, err := c.adoptRevision(ps, cr)
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		revisions = append(revisions, adopted)
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision < revisions[j].Revision
+	})
+
+	if len(errs) > 0 {
+		return revisions, errs[0]
+	}
+	return revisions, nil
+}
+
+// isRevisionOf returns true if the name of the revision is one the PodSet
+// gives to the revisions of its templates.
+func isRevisionOf(ps *v1alpha1.PodSet, cr *appsv1.ControllerRevision) bool {
+	hash := cr.Labels[podTemplateHashLabel]
+	if hash == "" {
+		return false
+	}
+	name := ps.Name + "-" + hash
+	return cr.Name == name || strings.HasPrefix(cr.Name, name+"-")
+}
+
+// adoptRevision sets the PodSet as controller of the revision. The patch
+// fails if the revision was deleted and recreated under the same name.
+func (c *podSetController) adoptRevision(ps *v1alpha1.PodSet, cr *appsv1.ControllerRevision) (*appsv1.ControllerRevision, error) {
+	ownerRef := metav1.NewControllerRef(ps, v1alpha1.SchemeGroupVersion.WithKind("PodSet"))
+	patch := fmt.Sprintf(`{"metadata":{"ownerReferences":[{"apiVersion":"%s","kind":"%s","name":"%s","uid":"%s","controller":true,"blockOwnerDeletion":true}],"uid":"%s"}}`,
+		ownerRef.APIVersion, ownerRef.Kind, ps.Name, ps.UID, cr.UID)
+	adopted, err := c.kc.AppsV1().ControllerRevisions(cr.Namespace).Patch(cr.Name, types.StrategicMergePatchType, []byte(patch))
+	if err == nil {
+		podSetLogger(ps.Namespace, ps.Name).V(2).Info("Adopted controller revision", "revision", cr.Name)
+	}
+	return adopted, err
+}
+
+// syncRevisions makes sure the current template of the PodSet is recorded as
+// its latest ControllerRevision, and returns that revision along with all the
+// revisions of the PodSet, oldest first.
+func (c *podSetController) syncRevisions(ps *v1alpha1.PodSet, hash string) (*appsv1.ControllerRevision, []*appsv1.ControllerRevision, error) {
+	revisions, err := c.claimRevisions(ps)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	maxRevision := int64(0)
+	var update *appsv1.ControllerRevision
+	for _, cr := range revisions {
+		if cr.Revision > maxRevision {
+			maxRevision = cr.Revision
+		}
+		if cr.Labels[podTemplateHashLabel] == hash {
+			update = cr
+		}
+	}
+
+	client := c.kc.AppsV1().ControllerRevisions(ps.Namespace)
+
+	// the template was seen before, e.g. after a rollback, make it the
+	// latest revision again
+	if update != nil {
+		if update.Revision == maxRevision {
+			return update, revisions, nil
+		}
+		crCopy := update.DeepCopy()
+		crCopy.Revision = maxRevision + 1
+		updated, err := client.Update(crCopy)
+		if err != nil {
+			return nil, nil, err
+		}
+		return updated, revisions, nil
+	}
+
+	cr, err := newRevision(ps, hash, maxRevision+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	created, err := client.Create(cr)
+	if errors.IsAlreadyExists(err) {
+		// The revision exists but isn't in the cache yet, or the name is
+		// taken.
+		existing, getErr := client.Get(cr.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return nil, nil, getErr
+		}
+		if metav1.IsControlledBy(existing, ps) {
+			return existing, revisions, nil
+		}
+		if metav1.GetControllerOf(existing) == nil && existing.Labels[podTemplateHashLabel] == hash {
+			if err := c.canAdoptFunc(ps)(); err != nil {
+				return nil, nil, err
+			}
+			adopted, err := c.adoptRevision(ps, existing)
+			if err != nil {
+				return nil, nil, err
+			}
+			return adopted, append(revisions, adopted), nil
+		}
+		return nil, nil, c.bumpCollisionCount(ps, cr.Name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return created, append(revisions, created), nil
+}
+
+// bumpCollisionCount records in the status that the name of the revision is
+// taken by another object, the next sync names the revision after the new
+// collision count.
+func (c *podSetController) bumpCollisionCount(ps *v1alpha1.PodSet, name string) error {
+	count := int32(0)
+	if ps.Status.CollisionCount != nil {
+		count = *ps.Status.CollisionCount
+	}
+	count++
+
+	newStatus := ps.Status.DeepCopy()
+	newStatus.CollisionCount = &count
+	if err := c.updatePodSetStatus(ps, *newStatus); err != nil {
+		return err
+	}
+	return fmt.Errorf("controller revision '%s' already exists and isn't controlled by the podset, bumped the collision count to %d", name, count)
+}
+
+// revisionName returns the name of the revision of the template with the
+// given hash, suffixed with the collision count once a collision happened.
+func revisionName(ps *v1alpha1.PodSet, hash string) string {
+	name := ps.Name + "-" + hash
+	if ps.Status.CollisionCount != nil && *ps.Status.CollisionCount > 0 {
+		name = fmt.Sprintf("%s-%d", name, *ps.Status.CollisionCount)
+	}
+	return name
+}
+
+// newRevision returns a ControllerRevision holding the template of the
+// PodSet.
+func newRevision(ps *v1alpha1.PodSet, hash string, revision int64) (*appsv1.ControllerRevision, error) {
+	data := revisionData{}
+	data.Spec.Template = ps.Spec.Template
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &appsv1.ControllerRevision{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      revisionName(ps, hash),
+			Namespace: ps.Namespace,
+			Labels: map[string]string{
+				podTemplateHashLabel: hash,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(ps, v1alpha1.SchemeGroupVersion.WithKind("PodSet")),
+			},
+		},
+		Data:     runtime.RawExtension{Raw: raw},
+		Revision: revision,
+	}, nil
+}
+
+// truncateHistory deletes the oldest revisions beyond the revision history
+// limit. The update revision and the revisions of existing pods are never
+// deleted.
+func (c *podSetController) truncateHistory(ps *v1alpha1.PodSet, revisions []*appsv1.ControllerRevision, update *appsv1.ControllerRevision, pods []*corev1.Pod) error {
+	limit := defaultRevisionHistoryLimit
+	if ps.Spec.RevisionHistoryLimit != nil {
+		limit = int(*ps.Spec.RevisionHistoryLimit)
+	}
+
+	live := map[string]bool{}
+	for _, p := range pods {
+		live[p.Labels[podTemplateHashLabel]] = true
+	}
+
+	history := []*appsv1.ControllerRevision{}
+	for _, cr := range revisions {
+		if cr.Name == update.Name || live[cr.Labels[podTemplateHashLabel]] {
+			continue
+		}
+		history = append(history, cr)
+	}
+	if len(history) <= limit {
+		return nil
+	}
+
+	// revisions are sorted oldest first
+	for _, cr := range history[:len(history)-limit] {
+		err := c.kc.AppsV1().
+			ControllerRevisions(ps.Namespace).
+			Delete(cr.Name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rollback restores the template of the revision spec.rollbackTo points to
+// and clears spec.rollbackTo. An unknown revision is reported and dropped.
+func (c *podSetController) rollback(ps *v1alpha1.PodSet) error {
+	revisions, err := c.claimRevisions(ps)
+	if err != nil {
+		return err
+	}
+
+	target := findRollbackRevision(revisions, ps.Spec.RollbackTo.Revision, computeHash(&ps.Spec.Template))
+
+	psCopy := ps.DeepCopy()
+	psCopy.Spec.RollbackTo = nil
+	if target == nil {
+		podSetLogger(ps.Namespace, ps.Name).Info("Unable to find revision to roll back to", "revision", ps.Spec.RollbackTo.Revision)
+		c.recorder.Eventf(ps, corev1.EventTypeWarning, rollbackRevisionNotFoundReason, "Unable to find revision %d to roll back to", ps.Spec.RollbackTo.Revision)
+	} else {
+		data := revisionData{}
+		if err := json.Unmarshal(target.Data.Raw, &data); err != nil {
+			return err
+		}
+		psCopy.Spec.Template = data.Spec.Template
+	}
+
+	_, err = c.psc.DemoV1alpha1().
+		PodSets(psCopy.Namespace).
+		Update(psCopy)
+	if err == nil && target != nil {
+		c.recorder.Eventf(ps, corev1.EventTypeNormal, rollbackDoneReason, "Rolled back podset %s to revision %d", ps.Name, target.Revision)
+	}
+
+	return err
+}
+
+// findRollbackRevision returns the revision with the given number, or the
+// one before the revision of the current template when the number is 0.
+func findRollbackRevision(revisions []*appsv1.ControllerRevision, revision int64, hash string) *appsv1.ControllerRevision {
+	if revision != 0 {
+		for _, cr := range revisions {
+			if cr.Revision == revision {
+				return cr
+			}
+		}
+		return nil
+	}
+
+	// revisions are sorted oldest first
+	for i := len(revisions) - 1; i > 0; i-- {
+		if revisions[i].Labels[podTemplateHashLabel] == hash {
+			return revisions[i-1]
+		}
+	}
+	return nil
+}
+
+// currentRevision returns the name of the revision the PodSet runs before
+// its ongoing update, or the update revision when all pods are updated.
+func currentRevision(ps *v1alpha1.PodSet, status v1alpha1.PodSetStatus, revisions []*appsv1.ControllerRevision, update *appsv1.ControllerRevision, oldPods []*corev1.Pod) string {
+	if status.UpdatedReplicas == status.Replicas || len(oldPods) == 0 {
+		return update.Name
+	}
+	if ps.Status.CurrentRevision != "" && ps.Status.CurrentRevision != update.Name {
+		return ps.Status.CurrentRevision
+	}
+
+	for _, cr := range revisions {
+		if cr.Labels[podTemplateHashLabel] == oldPods[0].Labels[podTemplateHashLabel] {
+			return cr.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"fmt"
+
+	psinformers "github.com/hrishin/podset-operator/pkg/client/informers/externalversions/demo/v1alpha1"
+	pslister "github.com/hrishin/podset-operator/pkg/client/listers/demo/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appsinformers "k8s.io/client-go/informers/apps/v1"
+	podinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// NamespaceInformers are the informers of the resources the controller
+// watches in one namespace, or in all of them if Namespace is
+// metav1.NamespaceAll.
+type NamespaceInformers struct {
+	Namespace           string
+	Pods                podinformers.PodInformer
+	PodSets             psinformers.PodSetInformer
+	ControllerRevisions appsinformers.ControllerRevisionInformer
+}
+
+// namespaceCache gives access to the informer caches of a namespace.
+type namespaceCache struct {
+	podIndexer   cache.Indexer
+	podHasSynced cache.InformerSynced
+	psLister     pslister.PodSetLister
+	psHasSynced  cache.InformerSynced
+	crIndexer    cache.Indexer
+	crHasSynced  cache.InformerSynced
+}
+
+func newNamespaceCache(informers NamespaceInformers) *namespaceCache {
+	return &namespaceCache{
+		podIndexer:   informers.Pods.Informer().GetIndexer(),
+		podHasSynced: informers.Pods.Informer().HasSynced,
+		psLister:     informers.PodSets.Lister(),
+		psHasSynced:  informers.PodSets.Informer().HasSynced,
+		crIndexer:    informers.ControllerRevisions.Informer().GetIndexer(),
+		crHasSynced:  informers.ControllerRevisions.Informer().HasSynced,
+	}
+}
+
+// cacheFor returns the caches holding the objects of the namespace.
+func (c *podSetController) cacheFor(namespace string) (*namespaceCache, error) {
+	if nc, ok := c.caches[namespace]; ok {
+		return nc, nil
+	}
+	if nc, ok := c.caches[metav1.NamespaceAll]; ok {
+		return nc, nil
+	}
+	return nil, fmt.Errorf("namespace '%s' isn't watched", namespace)
+}
+
+// cachesSynced returns the functions telling if the caches of every watched
+// namespace are synced.
+func (c *podSetController) cachesSynced() []cache.InformerSynced {
+	synced := []cache.InformerSynced{}
+	for _, nc := range c.caches {
+		synced = append(synced, nc.podHasSynced, nc.psHasSynced, nc.crHasSynced)
+	}
+	return synced
+}
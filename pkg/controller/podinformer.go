@@ -0,0 +1,216 @@
+package controller
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hrishin/podset-operator/pkg/apis/demo/v1alpha1"
+	"github.com/hrishin/podset-operator/pkg/client/clientset/versioned"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	kubeinformers "k8s.io/client-go/informers"
+	podinformers "k8s.io/client-go/informers/core/v1"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// podSetNameLabel is set on every pod created by a PodSet to the name
+	// of the PodSet, the pod informer only watches the pods carrying it.
+	podSetNameLabel = "demo.k8s.io/podset"
+
+	// podLabelsMigratedAnnotation is set on the PodSets whose pods all
+	// carry the podSetNameLabel.
+	podLabelsMigratedAnnotation = "demo.k8s.io/pod-labels-migrated"
+
+	// number of pods per page when listing the pods to label
+	labelPodsPageSize = 500
+)
+
+// NewPodInformer registers in the factory an informer of the pods created by
+// PodSets in the namespace, and returns it. It must be called before the pod
+// informer of the factory is used.
+//
+// Unlike the default pod informer it doesn't cache every pod of the
+// cluster, and the cached pods are stripped of the fields the controller
+// never reads. The label selector is set here rather than through the
+// factory's WithTweakListOptions, which would restrict the other informers
+// of the factory too.
+func NewPodInformer(factory kubeinformers.SharedInformerFactory, namespace string) podinformers.PodInformer {
+	factory.InformerFor(&corev1.Pod{}, func(client k8s.Interface, resyncPeriod time.Duration) cache.SharedIndexInformer {
+		return newPodInformer(client, namespace, resyncPeriod)
+	})
+	return factory.Core().V1().Pods()
+}
+
+func newPodInformer(client k8s.Interface, namespace string, resyncPeriod time.Duration) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = podSetNameLabel
+				list, err := client.CoreV1().Pods(namespace).List(options)
+				if err != nil {
+					return nil, err
+				}
+				for i := range list.Items {
+					list.Items[i] = *leanPod(&list.Items[i])
+				}
+				return list, nil
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = podSetNameLabel
+				w, err := client.CoreV1().Pods(namespace).Watch(options)
+				if err != nil {
+					return nil, err
+				}
+				return watch.Filter(w, func(event watch.Event) (watch.Event, bool) {
+					if pod, ok := event.Object.(*corev1.Pod); ok {
+						event.Object = leanPod(pod)
+					}
+					return event, true
+				}), nil
+			},
+		},
+		&corev1.Pod{},
+		resyncPeriod,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+}
+
+// leanPod returns a copy of the pod holding only the fields the controller
+// reads: its identity, labels, owners, the deletion cost, the node it runs
+// on and its status.
+func leanPod(pod *corev1.Pod) *corev1.Pod {
+	lean := &corev1.Pod{
+		TypeMeta: pod.TypeMeta,
+		ObjectMeta: metav1.ObjectMeta{
+			Name:                       pod.Name,
+			Namespace:                  pod.Namespace,
+			UID:                        pod.UID,
+			ResourceVersion:            pod.ResourceVersion,
+			CreationTimestamp:          pod.CreationTimestamp,
+			DeletionTimestamp:          pod.DeletionTimestamp,
+			DeletionGracePeriodSeconds: pod.DeletionGracePeriodSeconds,
+			Labels:                     pod.Labels,
+			OwnerReferences:            pod.OwnerReferences,
+		},
+		Spec: corev1.PodSpec{
+			NodeName: pod.Spec.NodeName,
+		},
+		Status: pod.Status,
+	}
+	if cost, ok := pod.Annotations[deletionCostAnnotation]; ok {
+		lean.Annotations = map[string]string{deletionCostAnnotation: cost}
+	}
+	return lean
+}
+
+// LabelPodSetPods sets the podSetNameLabel on the pods which belong to the
+// PodSets of the namespace but were created before the pod informer was
+// narrowed to that label: the pods controlled by a PodSet and matching its
+// selector. The orphan pods are left alone, they are only adopted if they
+// carry the label, at startup as at runtime.
+//
+// It must run before the pod informers start, the controller doesn't see
+// the pods missing the label and would replace them. It is a one-off
+// migration: the PodSets whose pods are all labelled are annotated with
+// podLabelsMigratedAnnotation and skipped afterwards, the pods which can't be
+// labelled are logged and retried on the next start.
+func LabelPodSetPods(kc k8s.Interface, pc versioned.Interface, namespace string) error {
+	podSets, err := pc.DemoV1alpha1().PodSets(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for i := range podSets.Items {
+		ps := &podSets.Items[i]
+		if _, ok := ps.Annotations[podLabelsMigratedAnnotation]; ok || ps.DeletionTimestamp != nil {
+			continue
+		}
+		logger := podSetLogger(ps.Namespace, ps.Name)
+		selector, err := podSetSelector(ps)
+		if err != nil {
+			logger.Error(err, "Invalid selector, not labelling the pods")
+			continue
+		}
+
+		labelled, failed, err := labelPods(kc, ps, selector)
+		if labelled > 0 {
+			logger.Info("Labelled pods", "count", labelled)
+		}
+		if err != nil {
+			logger.Error(err, "Error listing pods to label")
+			continue
+		}
+		if failed {
+			continue
+		}
+
+		psCopy := ps.DeepCopy()
+		if psCopy.Annotations == nil {
+			psCopy.Annotations = map[string]string{}
+		}
+		psCopy.Annotations[podLabelsMigratedAnnotation] = "true"
+		if _, err := pc.DemoV1alpha1().PodSets(ps.Namespace).Update(psCopy); err != nil {
+			logger.Error(err, "Error marking the pods as labelled")
+		}
+	}
+	return nil
+}
+
+// labelPods labels the pods controlled by the PodSet which are missing the
+// podSetNameLabel, and
+// returns how many were labelled and whether some of them couldn't be.
+func labelPods(kc k8s.Interface, ps *v1alpha1.PodSet, selector labels.Selector) (int, bool, error) {
+	unlabelled, err := labels.NewRequirement(podSetNameLabel, selection.DoesNotExist, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{podSetNameLabel: ps.Name},
+		},
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	logger := podSetLogger(ps.Namespace, ps.Name)
+	labelled := 0
+	failed := false
+	options := metav1.ListOptions{
+		LabelSelector: selector.Add(*unlabelled).String(),
+		Limit:         labelPodsPageSize,
+	}
+	for {
+		pods, err := kc.CoreV1().Pods(ps.Namespace).List(options)
+		if err != nil {
+			return labelled, failed, err
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if controllerRef := metav1.GetControllerOf(pod); controllerRef == nil || controllerRef.UID != ps.UID {
+				continue
+			}
+			_, err := kc.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.StrategicMergePatchType, patch)
+			switch {
+			case errors.IsNotFound(err):
+			case err != nil:
+				logger.Error(err, "Error labelling pod", "pod", pod.Name)
+				failed = true
+			default:
+				labelled++
+			}
+		}
+		if pods.Continue == "" {
+			return labelled, failed, nil
+		}
+		options.Continue = pods.Continue
+	}
+}
@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/hrishin/podset-operator/pkg/apis/demo/v1alpha1"
+	psfake "github.com/hrishin/podset-operator/pkg/client/clientset/versioned/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	podinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestLabelPodSetPods(t *testing.T) {
+	newPodSet := func() *v1alpha1.PodSet {
+		return &v1alpha1.PodSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "ps-uid"},
+			Spec: v1alpha1.PodSetSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+				},
+			},
+		}
+	}
+	psRef := *metav1.NewControllerRef(newPodSet(), v1alpha1.SchemeGroupVersion.WithKind("PodSet"))
+	rsRef := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web", UID: "rs-uid", Controller: boolPtr(true)}
+
+	tests := []struct {
+		name      string
+		labels    map[string]string
+		ownerRefs []metav1.OwnerReference
+		migrated  bool
+		patchErr  bool
+		want      string
+		// whether the PodSet is annotated as migrated afterwards
+		wantMigrated bool
+	}{
+		{
+			name:         "controlled by the podset",
+			labels:       map[string]string{"app": "web"},
+			ownerRefs:    []metav1.OwnerReference{psRef},
+			want:         "web",
+			wantMigrated: true,
+		},
+		{
+			name:         "orphan matching the podset",
+			labels:       map[string]string{"app": "web"},
+			wantMigrated: true,
+		},
+		{
+			name:         "controlled by another controller",
+			labels:       map[string]string{"app": "web"},
+			ownerRefs:    []metav1.OwnerReference{rsRef},
+			wantMigrated: true,
+		},
+		{
+			name:         "not matching the podset",
+			labels:       map[string]string{"app": "other"},
+			wantMigrated: true,
+		},
+		{
+			name:         "already labelled",
+			labels:       map[string]string{"app": "web", podSetNameLabel: "previous"},
+			want:         "previous",
+			wantMigrated: true,
+		},
+		{
+			name:         "podset already migrated",
+			labels:       map[string]string{"app": "web"},
+			ownerRefs:    []metav1.OwnerReference{psRef},
+			migrated:     true,
+			wantMigrated: true,
+		},
+		{
+			name:      "patch failure",
+			labels:    map[string]string{"app": "web"},
+			ownerRefs: []metav1.OwnerReference{psRef},
+			patchErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := newPodSet()
+			if tt.migrated {
+				ps.Annotations = map[string]string{podLabelsMigratedAnnotation: "true"}
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "pod",
+					Namespace:       "default",
+					Labels:          tt.labels,
+					OwnerReferences: tt.ownerRefs,
+				},
+			}
+			kc := fake.NewSimpleClientset(pod)
+			pc := psfake.NewSimpleClientset(ps)
+			if tt.patchErr {
+				kc.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, kruntime.Object, error) {
+					return true, nil, fmt.Errorf("denied by a webhook")
+				})
+			}
+
+			if err := LabelPodSetPods(kc, pc, metav1.NamespaceAll); err != nil {
+				t.Fatalf("LabelPodSetPods() error = %v", err)
+			}
+
+			got, err := kc.CoreV1().Pods("default").Get("pod", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if got.Labels[podSetNameLabel] != tt.want {
+				t.Errorf("label %s = %q, want %q", podSetNameLabel, got.Labels[podSetNameLabel], tt.want)
+			}
+			gotPodSet, err := pc.DemoV1alpha1().PodSets("default").Get("web", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if _, migrated := gotPodSet.Annotations[podLabelsMigratedAnnotation]; migrated != tt.wantMigrated {
+				t.Errorf("migrated = %v, want %v", migrated, tt.wantMigrated)
+			}
+		})
+	}
+}
+
+// BenchmarkPodInformer compares the heap retained by the default pod
+// informer and by the PodSet pod informer, in a cluster of 50k pods of which
+// one in ten belongs to a PodSet.
+func BenchmarkPodInformer(b *testing.B) {
+	objs := []kruntime.Object{}
+	for i := 0; i < 50000; i++ {
+		objs = append(objs, benchmarkPod(i, i%10 == 0))
+	}
+	client := fake.NewSimpleClientset(objs...)
+
+	b.Run("AllPods", func(b *testing.B) {
+		benchmarkInformer(b, func() cache.SharedIndexInformer {
+			return podinformers.NewPodInformer(client, metav1.NamespaceAll, 0,
+				cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		})
+	})
+	b.Run("PodSetPods", func(b *testing.B) {
+		benchmarkInformer(b, func() cache.SharedIndexInformer {
+			return newPodInformer(client, metav1.NamespaceAll, 0)
+		})
+	})
+}
+
+// benchmarkInformer syncs the informer and reports the heap its cache
+// retains.
+func benchmarkInformer(b *testing.B, newInformer func() cache.SharedIndexInformer) {
+	retained := int64(0)
+	for i := 0; i < b.N; i++ {
+		before := heapAlloc()
+		informer := newInformer()
+		stopCh := make(chan struct{})
+		go informer.Run(stopCh)
+		if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+			b.Fatal("cache not synced")
+		}
+		retained += heapAlloc() - before
+		runtime.KeepAlive(informer)
+		close(stopCh)
+	}
+	b.ReportMetric(float64(retained)/float64(b.N), "retained-B/op")
+}
+
+func heapAlloc() int64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapAlloc)
+}
+
+// benchmarkPod returns a pod with the fields a typical pod carries.
+func benchmarkPod(i int, podSet bool) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("pod-%d", i),
+			Namespace: "default",
+			UID:       types.UID(fmt.Sprintf("uid-%d", i)),
+			Labels:    map[string]string{"app": "web"},
+			Annotations: map[string]string{
+				"kubectl.kubernetes.io/last-applied-configuration": strings.Repeat("x", 1024),
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: fmt.Sprintf("node-%d", i%100),
+			Containers: []corev1.Container{{
+				Name:    "web",
+				Image:   "nginx:1.15",
+				Command: []string{"nginx", "-g", "daemon off;"},
+				Env: []corev1.EnvVar{
+					{Name: "LOG_LEVEL", Value: "info"},
+					{Name: "WORKERS", Value: "4"},
+				},
+				Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 80}},
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "config", MountPath: "/etc/nginx/conf.d"},
+				},
+			}},
+			Volumes: []corev1.Volume{{
+				Name: "config",
+				VolumeSource: corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "web"},
+					},
+				},
+			}},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+			},
+		},
+	}
+	if podSet {
+		pod.Labels[podSetNameLabel] = "web"
+	}
+	return pod
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
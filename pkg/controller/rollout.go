@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/hrishin/podset-operator/pkg/apis/demo/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/rand"
+)
+
+const (
+	// podTemplateHashLabel is added to every pod, it holds the hash of the
+	// template the pod was created from.
+	podTemplateHashLabel = "pod-template-hash"
+)
+
+var (
+	defaultMaxSurge       = intstr.FromString("25%")
+	defaultMaxUnavailable = intstr.FromString("25%")
+)
+
+// computeHash returns a hash of the pod template, safe to be used as a label
+// value.
+func computeHash(template *corev1.PodTemplateSpec) string {
+	hasher := fnv.New32a()
+	// json.Marshal sorts map keys, so the same template always gives the
+	// same hash.
+	data, _ := json.Marshal(template)
+	hasher.Write(data)
+
+	return rand.SafeEncodeString(fmt.Sprint(hasher.Sum32()))
+}
+
+// splitPodsByHash separates the pods created from the template with the
+// given hash from the others.
+func splitPodsByHash(pods []*corev1.Pod, hash string) (newPods, oldPods []*corev1.Pod) {
+	for _, p := range pods {
+		if p.Labels[podTemplateHashLabel] == hash {
+			newPods = append(newPods, p)
+		} else {
+			oldPods = append(oldPods, p)
+		}
+	}
+	return newPods, oldPods
+}
+
+// oldPodsRunning returns true if any pod not created from the template with
+// the given hash is still running, including the ones being deleted.
+func oldPodsRunning(pods []*corev1.Pod, hash string) bool {
+	for _, p := range pods {
+		if p.Labels[podTemplateHashLabel] == hash {
+			continue
+		}
+		if p.Status.Phase != corev1.PodSucceeded && p.Status.Phase != corev1.PodFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// rolloutRolling replaces the old pods by new ones, creating new pods as long
+// as there are at most maxSurge pods above the desired replicas, and deleting
+// old pods as long as at most maxUnavailable pods are unavailable.
+func (c *podSetController) rolloutRolling(ps *v1alpha1.PodSet, newPods, oldPods []*corev1.Pod) error {
+	maxSurge, maxUnavailable, err := resolveFenceposts(ps)
+	if err != nil {
+		return err
+	}
+	replicas := int(ps.Spec.Replicas)
+	total := len(newPods) + len(oldPods)
+
+	// scale up the new pods within the surge budget
+	if len(newPods) < replicas {
+		if canCreate := integerMin(replicas+maxSurge-total, replicas-len(newPods)); canCreate > 0 {
+			return c.createPods(ps, canCreate)
+		}
+	}
+	// the PodSet was scaled down during the update
+	if len(newPods) > replicas {
+		return c.deletePods(ps, c.podsToDelete(ps, newPods, len(newPods)-replicas))
+	}
+
+	// scale down the old pods within the unavailability budget
+	now := metav1.Now()
+	minAvailable := replicas - maxUnavailable
+	var oldAvailable, oldUnavailable []*corev1.Pod
+	for _, p := range oldPods {
+		if isPodAvailable(p, ps.Spec.MinReadySeconds, now) {
+			oldAvailable = append(oldAvailable, p)
+		} else {
+			oldUnavailable = append(oldUnavailable, p)
+		}
+	}
+	newAvailable := 0
+	for _, p := range newPods {
+		if isPodAvailable(p, ps.Spec.MinReadySeconds, now) {
+			newAvailable++
+		}
+	}
+
+	// New pods which aren't available yet may still become available, keep
+	// room for them before deleting anything.
+	maxScaledDown := total - minAvailable - (len(newPods) - newAvailable)
+	if maxScaledDown <= 0 {
+		return nil
+	}
+
+	// Unavailable old pods go first, they don't affect the availability.
+	victims := c.podsToDelete(ps, oldUnavailable, integerMin(len(oldUnavailable), maxScaledDown))
+	canDeleteAvailable := integerMin(maxScaledDown-len(victims), len(oldAvailable)+newAvailable-minAvailable)
+	if canDeleteAvailable > 0 {
+		victims = append(victims, c.podsToDelete(ps, oldAvailable, integerMin(canDeleteAvailable, len(oldAvailable)))...)
+	}
+	if len(victims) == 0 {
+		return nil
+	}
+
+	return c.deletePods(ps, victims)
+}
+
+// resolveFenceposts returns the maximum surge and unavailability of the
+// rolling update in number of pods. Both can't be 0, or the update could never
+// make progress, so maxUnavailable is bumped to 1 in that case.
+func resolveFenceposts(ps *v1alpha1.PodSet) (int, int, error) {
+	maxSurge, maxUnavailable := &defaultMaxSurge, &defaultMaxUnavailable
+	if ru := ps.Spec.Strategy.RollingUpdate; ru != nil {
+		maxSurge = intstr.ValueOrDefault(ru.MaxSurge, defaultMaxSurge)
+		maxUnavailable = intstr.ValueOrDefault(ru.MaxUnavailable, defaultMaxUnavailable)
+	}
+
+	surge, err := intstr.GetValueFromIntOrPercent(maxSurge, int(ps.Spec.Replicas), true)
+	if err != nil {
+		return 0, 0, err
+	}
+	unavailable, err := intstr.GetValueFromIntOrPercent(maxUnavailable, int(ps.Spec.Replicas), false)
+	if err != nil {
+		return 0, 0, err
+	}
+	if surge == 0 && unavailable == 0 {
+		unavailable = 1
+	}
+
+	return surge, unavailable, nil
+}
@@ -0,0 +1,228 @@
+package controller
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/hrishin/podset-operator/pkg/apis/demo/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// deletionCostAnnotation lets users rank pods for scale down, pods with
+	// a lower cost are deleted first. Same annotation as the upstream
+	// ReplicaSet controller.
+	deletionCostAnnotation = "controller.kubernetes.io/pod-deletion-cost"
+
+	// zoneLabel is the node label holding its zone.
+	zoneLabel = "topology.kubernetes.io/zone"
+)
+
+// victimRanker ranks the pods of a PodSet for deletion.
+type victimRanker struct {
+	policy v1alpha1.ScaleDownPolicy
+	// number of candidate pods per node and per zone
+	podsPerNode map[string]int
+	podsPerZone map[string]int
+	zones       map[string]string
+}
+
+// rankedPod is a candidate pod along with the values ranking it, parsed once
+// rather than on every comparison.
+type rankedPod struct {
+	pod  *corev1.Pod
+	cost int32
+	// the Ready condition of the pod, nil if it isn't ready
+	ready    *corev1.PodCondition
+	restarts int32
+}
+
+// podsToDelete returns count pods out of the given ones, picked according to
+// the scale down policy of the PodSet.
+func (c *podSetController) podsToDelete(ps *v1alpha1.PodSet, pods []*corev1.Pod, count int) []*corev1.Pod {
+	if count >= len(pods) {
+		return pods
+	}
+
+	r := &victimRanker{
+		policy:      ps.Spec.ScaleDownPolicy,
+		podsPerNode: map[string]int{},
+		podsPerZone: map[string]int{},
+		zones:       map[string]string{},
+	}
+	candidates := make([]*rankedPod, 0, len(pods))
+	for _, p := range pods {
+		candidates = append(candidates, &rankedPod{
+			pod:      p,
+			cost:     deletionCost(p),
+			ready:    podReadyCondition(p),
+			restarts: maxContainerRestarts(p),
+		})
+		if p.Spec.NodeName == "" {
+			continue
+		}
+		r.podsPerNode[p.Spec.NodeName]++
+		if _, ok := r.zones[p.Spec.NodeName]; !ok {
+			r.zones[p.Spec.NodeName] = c.nodeZone(p.Spec.NodeName)
+		}
+		r.podsPerZone[r.zones[p.Spec.NodeName]]++
+	}
+
+	victims := make([]*corev1.Pod, 0, count)
+	if !r.spreading() {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return r.less(candidates[i], candidates[j])
+		})
+		for _, rp := range candidates[:count] {
+			victims = append(victims, rp.pod)
+		}
+		return victims
+	}
+
+	// Pick the victims one by one, so the spreading policies see the
+	// counts left by the previous picks.
+	for len(victims) < count {
+		best := 0
+		for i := 1; i < len(candidates); i++ {
+			if r.less(candidates[i], candidates[best]) {
+				best = i
+			}
+		}
+		victim := candidates[best].pod
+		victims = append(victims, victim)
+		candidates = append(candidates[:best], candidates[best+1:]...)
+		if victim.Spec.NodeName != "" {
+			r.podsPerNode[victim.Spec.NodeName]--
+			r.podsPerZone[r.zones[victim.Spec.NodeName]]--
+		}
+	}
+
+	return victims
+}
+
+// spreading returns true if the policy ranks the pods by the number of pods
+// left on their node or zone, which changes with every pick.
+func (r *victimRanker) spreading() bool {
+	return r.policy == v1alpha1.MostLoadedNodeScaleDownPolicy || r.policy == v1alpha1.ZoneBalancedScaleDownPolicy
+}
+
+// nodeZone returns the zone of the node, or an empty string if it is unknown.
+func (c *podSetController) nodeZone(name string) string {
+	if c.nodeLister == nil {
+		return ""
+	}
+	node, err := c.nodeLister.Get(name)
+	if err != nil {
+		return ""
+	}
+	if zone, ok := node.Labels[zoneLabel]; ok {
+		return zone
+	}
+	return node.Labels[corev1.LabelZoneFailureDomain]
+}
+
+// less returns true if the pod of ri should be deleted before the pod of rj.
+func (r *victimRanker) less(ri, rj *rankedPod) bool {
+	i, j := ri.pod, rj.pod
+	switch r.policy {
+	case v1alpha1.NewestScaleDownPolicy:
+		if ri.cost != rj.cost {
+			return ri.cost < rj.cost
+		}
+		return j.CreationTimestamp.Before(&i.CreationTimestamp)
+	case v1alpha1.OldestScaleDownPolicy:
+		if ri.cost != rj.cost {
+			return ri.cost < rj.cost
+		}
+		return i.CreationTimestamp.Before(&j.CreationTimestamp)
+	case v1alpha1.MostLoadedNodeScaleDownPolicy:
+		if ri.cost != rj.cost {
+			return ri.cost < rj.cost
+		}
+		if ni, nj := r.podsPerNode[i.Spec.NodeName], r.podsPerNode[j.Spec.NodeName]; ni != nj {
+			return ni > nj
+		}
+		return j.CreationTimestamp.Before(&i.CreationTimestamp)
+	case v1alpha1.ZoneBalancedScaleDownPolicy:
+		if ri.cost != rj.cost {
+			return ri.cost < rj.cost
+		}
+		zi, zj := r.podsPerZone[r.zones[i.Spec.NodeName]], r.podsPerZone[r.zones[j.Spec.NodeName]]
+		if zi != zj {
+			return zi > zj
+		}
+		if ni, nj := r.podsPerNode[i.Spec.NodeName], r.podsPerNode[j.Spec.NodeName]; ni != nj {
+			return ni > nj
+		}
+		return j.CreationTimestamp.Before(&i.CreationTimestamp)
+	default:
+		return r.lessNotReadyFirst(ri, rj)
+	}
+}
+
+// lessNotReadyFirst ranks the pods the way the upstream ReplicaSet controller
+// does, the cheapest pods to lose go first.
+func (r *victimRanker) lessNotReadyFirst(ri, rj *rankedPod) bool {
+	i, j := ri.pod, rj.pod
+	// 1. Unassigned < assigned
+	if (i.Spec.NodeName == "") != (j.Spec.NodeName == "") {
+		return i.Spec.NodeName == ""
+	}
+	// 2. Pending < Unknown < Running
+	if pi, pj := podPhaseOrdinal(i.Status.Phase), podPhaseOrdinal(j.Status.Phase); pi != pj {
+		return pi < pj
+	}
+	// 3. Not ready < ready
+	if (ri.ready == nil) != (rj.ready == nil) {
+		return ri.ready == nil
+	}
+	// 4. Lower deletion cost < higher deletion cost
+	if ri.cost != rj.cost {
+		return ri.cost < rj.cost
+	}
+	// 5. More pods on the same node < fewer
+	if ni, nj := r.podsPerNode[i.Spec.NodeName], r.podsPerNode[j.Spec.NodeName]; ni != nj {
+		return ni > nj
+	}
+	// 6. Been ready for less time < more time
+	if ri.ready != nil && rj.ready != nil && !ri.ready.LastTransitionTime.Equal(&rj.ready.LastTransitionTime) {
+		return rj.ready.LastTransitionTime.Before(&ri.ready.LastTransitionTime)
+	}
+	// 7. More restarts < fewer restarts
+	if ri.restarts != rj.restarts {
+		return ri.restarts > rj.restarts
+	}
+	// 8. Newer < older
+	return j.CreationTimestamp.Before(&i.CreationTimestamp)
+}
+
+// deletionCost returns the deletion cost of the pod, 0 if it isn't set or
+// invalid.
+func deletionCost(pod *corev1.Pod) int32 {
+	cost, err := strconv.ParseInt(pod.Annotations[deletionCostAnnotation], 10, 32)
+	if err != nil {
+		return 0
+	}
+	return int32(cost)
+}
+
+func podPhaseOrdinal(phase corev1.PodPhase) int {
+	switch phase {
+	case corev1.PodPending:
+		return 0
+	case corev1.PodRunning:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func maxContainerRestarts(pod *corev1.Pod) int32 {
+	restarts := int32(0)
+	for _, c := range pod.Status.ContainerStatuses {
+		if c.RestartCount > restarts {
+			restarts = c.RestartCount
+		}
+	}
+	return restarts
+}
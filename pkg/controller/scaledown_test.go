@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/hrishin/podset-operator/pkg/apis/demo/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	podlister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// scaleDownPod describes a candidate pod, pods are created in the order they
+// are listed.
+type scaleDownPod struct {
+	name     string
+	node     string
+	notReady bool
+	cost     string
+}
+
+func TestPodsToDelete(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy v1alpha1.ScaleDownPolicy
+		pods   []scaleDownPod
+		count  int
+		want   []string
+	}{
+		{
+			name:   "newest",
+			policy: v1alpha1.NewestScaleDownPolicy,
+			pods:   []scaleDownPod{{name: "p0", node: "a"}, {name: "p1", node: "a"}, {name: "p2", node: "a"}, {name: "p3", node: "a"}},
+			count:  2,
+			want:   []string{"p2", "p3"},
+		},
+		{
+			name:   "oldest",
+			policy: v1alpha1.OldestScaleDownPolicy,
+			pods:   []scaleDownPod{{name: "p0", node: "a"}, {name: "p1", node: "a"}, {name: "p2", node: "a"}, {name: "p3", node: "a"}},
+			count:  2,
+			want:   []string{"p0", "p1"},
+		},
+		{
+			name:   "deletion cost before age",
+			policy: v1alpha1.OldestScaleDownPolicy,
+			pods:   []scaleDownPod{{name: "p0", node: "a", cost: "10"}, {name: "p1", node: "a"}, {name: "p2", node: "a", cost: "-5"}},
+			count:  2,
+			want:   []string{"p1", "p2"},
+		},
+		{
+			name:   "invalid deletion cost counts as 0",
+			policy: v1alpha1.NewestScaleDownPolicy,
+			pods:   []scaleDownPod{{name: "p0", node: "a"}, {name: "p1", node: "a", cost: "5"}, {name: "p2", node: "a", cost: "many"}},
+			count:  2,
+			want:   []string{"p0", "p2"},
+		},
+		{
+			name:   "not ready first",
+			policy: v1alpha1.NotReadyFirstScaleDownPolicy,
+			pods:   []scaleDownPod{{name: "p0", node: "a"}, {name: "p1", node: "a", notReady: true}, {name: "p2"}, {name: "p3", node: "a"}},
+			count:  2,
+			want:   []string{"p1", "p2"},
+		},
+		{
+			name:   "not ready first ranks crowded nodes before age",
+			policy: v1alpha1.NotReadyFirstScaleDownPolicy,
+			pods:   []scaleDownPod{{name: "p0", node: "a"}, {name: "p1", node: "a"}, {name: "p2", node: "a"}, {name: "p3", node: "b"}},
+			count:  1,
+			want:   []string{"p2"},
+		},
+		{
+			name:   "most loaded node recounts after every pick",
+			policy: v1alpha1.MostLoadedNodeScaleDownPolicy,
+			pods: []scaleDownPod{{name: "p0", node: "a"}, {name: "p1", node: "a"}, {name: "p2", node: "a"},
+				{name: "p3", node: "b"}, {name: "p4", node: "b"}},
+			count: 3,
+			want:  []string{"p1", "p2", "p4"},
+		},
+		{
+			name:   "zone balanced recounts after every pick",
+			policy: v1alpha1.ZoneBalancedScaleDownPolicy,
+			pods: []scaleDownPod{{name: "p0", node: "a"}, {name: "p1", node: "b"}, {name: "p2", node: "c"},
+				{name: "p3", node: "c"}, {name: "p4", node: "a"}},
+			count: 2,
+			want:  []string{"p3", "p4"},
+		},
+		{
+			name:   "deletion cost before spreading",
+			policy: v1alpha1.MostLoadedNodeScaleDownPolicy,
+			pods:   []scaleDownPod{{name: "p0", node: "a", cost: "1"}, {name: "p1", node: "a", cost: "1"}, {name: "p2", node: "b"}},
+			count:  1,
+			want:   []string{"p2"},
+		},
+		{
+			name:   "all pods",
+			policy: v1alpha1.NewestScaleDownPolicy,
+			pods:   []scaleDownPod{{name: "p0", node: "a"}, {name: "p1", node: "a"}},
+			count:  3,
+			want:   []string{"p0", "p1"},
+		},
+	}
+
+	// nodes a and b are in zone z1, c in zone z2
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for name, zone := range map[string]string{"a": "z1", "b": "z1", "c": "z2"} {
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{zoneLabel: zone}}}
+		if err := nodes.Add(node); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	c := &podSetController{nodeLister: podlister.NewNodeLister(nodes)}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := newTestPodSet()
+			ps.Spec.ScaleDownPolicy = tt.policy
+
+			pods := []*corev1.Pod{}
+			for i, p := range tt.pods {
+				pod := &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:              p.name,
+						Namespace:         "default",
+						UID:               types.UID(p.name + "-uid"),
+						CreationTimestamp: metav1.Unix(int64(i), 0),
+					},
+					Spec:   corev1.PodSpec{NodeName: p.node},
+					Status: corev1.PodStatus{Phase: corev1.PodRunning},
+				}
+				if p.cost != "" {
+					pod.Annotations = map[string]string{deletionCostAnnotation: p.cost}
+				}
+				if !p.notReady {
+					pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+				}
+				pods = append(pods, pod)
+			}
+
+			got := []string{}
+			for _, p := range c.podsToDelete(ps, pods, tt.count) {
+				got = append(got, p.Name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podsToDelete() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"hash/fnv"
+
+	"github.com/hrishin/podset-operator/pkg/apis/demo/v1alpha1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Sharding selects the PodSets an instance of the operator owns, so that
+// several instances never sync the same PodSet.
+type Sharding struct {
+	// Selector the labels of the owned PodSets must match, nil for all
+	// PodSets.
+	Selector labels.Selector
+	// The owned PodSets are the ones whose namespace/name hashes to Index
+	// modulo Count. A Count of 0 or 1 disables the hash-based sharding.
+	Index int
+	Count int
+}
+
+// owns returns true if the PodSet belongs to this instance.
+func (s Sharding) owns(ps *v1alpha1.PodSet) bool {
+	if s.Selector != nil && !s.Selector.Matches(labels.Set(ps.Labels)) {
+		return false
+	}
+	return s.ownsKey(ps.Namespace, ps.Name)
+}
+
+// ownsKey returns true if the PodSet with the given namespace and name
+// hashes to this instance.
+func (s Sharding) ownsKey(namespace, name string) bool {
+	if s.Count <= 1 {
+		return true
+	}
+	hasher := fnv.New32a()
+	hasher.Write([]byte(namespace + "/" + name))
+	return int(hasher.Sum32()%uint32(s.Count)) == s.Index
+}
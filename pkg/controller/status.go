@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hrishin/podset-operator/pkg/apis/demo/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// reasons of the PodSet conditions
+	minimumReplicasAvailable   = "MinimumReplicasAvailable"
+	minimumReplicasUnavailable = "MinimumReplicasUnavailable"
+	scalingPodSetReason        = "ScalingPodSet"
+	updatingPodSetReason       = "UpdatingPodSet"
+	podSetAvailableReason      = "PodSetAvailable"
+	failedCreateReason         = "FailedCreate"
+	failedDeleteReason         = "FailedDelete"
+	invalidSelectorReason      = "InvalidSelector"
+)
+
+// calculateStatus computes the status of the PodSet from its selector, its
+// active pods and the error, if any, returned while creating or deleting pods.
+func calculateStatus(ps *v1alpha1.PodSet, selector labels.Selector, pods []*corev1.Pod, manageErr error) v1alpha1.PodSetStatus {
+	newStatus := ps.Status.DeepCopy()
+	now := metav1.Now()
+
+	hash := computeHash(&ps.Spec.Template)
+	updatedReplicas := int32(0)
+	readyReplicas := int32(0)
+	availableReplicas := int32(0)
+	for _, pod := range pods {
+		if pod.Labels[podTemplateHashLabel] == hash {
+			updatedReplicas++
+		}
+		if isPodReady(pod) {
+			readyReplicas++
+			if isPodAvailable(pod, ps.Spec.MinReadySeconds, now) {
+				availableReplicas++
+			}
+		}
+	}
+
+	newStatus.Replicas = int32(len(pods))
+	newStatus.UpdatedReplicas = updatedReplicas
+	newStatus.ReadyReplicas = readyReplicas
+	newStatus.AvailableReplicas = availableReplicas
+	newStatus.ObservedGeneration = ps.Generation
+	newStatus.Selector = selector.String()
+
+	if availableReplicas >= ps.Spec.Replicas {
+		setCondition(newStatus, newCondition(v1alpha1.PodSetAvailable, corev1.ConditionTrue,
+			minimumReplicasAvailable, "PodSet has its desired replicas available."))
+	} else {
+		setCondition(newStatus, newCondition(v1alpha1.PodSetAvailable, corev1.ConditionFalse,
+			minimumReplicasUnavailable, fmt.Sprintf("PodSet has %d of %d replicas available.", availableReplicas, ps.Spec.Replicas)))
+	}
+
+	if updatedReplicas < newStatus.Replicas {
+		setCondition(newStatus, newCondition(v1alpha1.PodSetProgressing, corev1.ConditionTrue,
+			updatingPodSetReason, fmt.Sprintf("PodSet is rolling out its template, %d of %d replicas updated.", updatedReplicas, ps.Spec.Replicas)))
+	} else if newStatus.Replicas != ps.Spec.Replicas || availableReplicas < ps.Spec.Replicas {
+		setCondition(newStatus, newCondition(v1alpha1.PodSetProgressing, corev1.ConditionTrue,
+			scalingPodSetReason, fmt.Sprintf("PodSet is scaling from %d to %d replicas.", newStatus.Replicas, ps.Spec.Replicas)))
+	} else {
+		setCondition(newStatus, newCondition(v1alpha1.PodSetProgressing, corev1.ConditionTrue,
+			podSetAvailableReason, "PodSet has successfully progressed."))
+	}
+
+	if failure := replicaFailureOf(ps, pods, manageErr); failure != nil {
+		setCondition(newStatus, newCondition(v1alpha1.PodSetReplicaFailure, corev1.ConditionTrue,
+			failure.reason, failure.message))
+	} else {
+		removeCondition(newStatus, v1alpha1.PodSetReplicaFailure)
+	}
+
+	return *newStatus
+}
+
+// replicaFailureOf returns why the PodSet fails to run its replicas, if it
+// does: either the error returned while creating or deleting pods, or pods
+// which can't run their containers.
+func replicaFailureOf(ps *v1alpha1.PodSet, pods []*corev1.Pod, manageErr error) *replicaFailure {
+	if manageErr == nil {
+		return podsFailure(pods)
+	}
+	if failure, ok := manageErr.(*replicaFailure); ok {
+		return failure
+	}
+
+	reason := failedCreateReason
+	if diff := len(pods) - int(ps.Spec.Replicas); diff > 0 {
+		reason = failedDeleteReason
+	}
+	return &replicaFailure{reason: reason, message: manageErr.Error()}
+}
+
+// newCondition creates a new PodSet condition.
+func newCondition(condType v1alpha1.PodSetConditionType, status corev1.ConditionStatus, reason, msg string) v1alpha1.PodSetCondition {
+	return v1alpha1.PodSetCondition{
+		Type:               condType,
+		Status:             status,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            msg,
+	}
+}
+
+// getCondition returns the condition with the provided type.
+func getCondition(status v1alpha1.PodSetStatus, condType v1alpha1.PodSetConditionType) *v1alpha1.PodSetCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == condType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// setCondition adds or replaces the condition of the same type. The last
+// transition time is kept as long as the status of the condition stays the
+// same, and nothing changes when the reason and message are the same too.
+func setCondition(status *v1alpha1.PodSetStatus, condition v1alpha1.PodSetCondition) {
+	current := getCondition(*status, condition.Type)
+	if current != nil && current.Status == condition.Status && current.Reason == condition.Reason && current.Message == condition.Message {
+		return
+	}
+	if current != nil && current.Status == condition.Status {
+		condition.LastTransitionTime = current.LastTransitionTime
+	}
+
+	removeCondition(status, condition.Type)
+	status.Conditions = append(status.Conditions, condition)
+}
+
+// removeCondition removes the condition with the provided type.
+func removeCondition(status *v1alpha1.PodSetStatus, condType v1alpha1.PodSetConditionType) {
+	var conditions []v1alpha1.PodSetCondition
+	for _, c := range status.Conditions {
+		if c.Type == condType {
+			continue
+		}
+		conditions = append(conditions, c)
+	}
+	status.Conditions = conditions
+}
+
+// isPodReady returns true if the pod has a true Ready condition.
+func isPodReady(pod *corev1.Pod) bool {
+	return podReadyCondition(pod) != nil
+}
+
+// isPodAvailable returns true if the pod has been ready for at least
+// minReadySeconds.
+func isPodAvailable(pod *corev1.Pod, minReadySeconds int32, now metav1.Time) bool {
+	c := podReadyCondition(pod)
+	if c == nil {
+		return false
+	}
+	minReadySecondsDuration := time.Duration(minReadySeconds) * time.Second
+	return minReadySeconds == 0 || !c.LastTransitionTime.IsZero() && c.LastTransitionTime.Add(minReadySecondsDuration).Before(now.Time)
+}
+
+// podReadyCondition returns the Ready condition of the pod if it's true.
+func podReadyCondition(pod *corev1.Pod) *corev1.PodCondition {
+	for i := range pod.Status.Conditions {
+		c := &pod.Status.Conditions[i]
+		if c.Type == corev1.PodReady && c.Status == corev1.ConditionTrue {
+			return c
+		}
+	}
+	return nil
+}
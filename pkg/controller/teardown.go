@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/hrishin/podset-operator/pkg/apis/demo/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// reason of the Progressing condition and the events of the ordered
+	// teardown
+	orderedTeardownReason   = "OrderedTeardown"
+	teardownCompletedReason = "TeardownCompleted"
+
+	defaultTeardownBatchSize = 1
+)
+
+// hasOrderedTeardownFinalizer returns true if the PodSet asked for the
+// ordered teardown of its pods.
+func hasOrderedTeardownFinalizer(ps *v1alpha1.PodSet) bool {
+	for _, f := range ps.Finalizers {
+		if f == v1alpha1.OrderedTeardownFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// teardown deletes the pods of a deleted PodSet teardownBatchSize at a time,
+// waiting for the pods of a batch to be gone before deleting the next ones,
+// and removes the ordered teardown finalizer once no pod is left.
+func (c *podSetController) teardown(ps *v1alpha1.PodSet, needsSync bool) error {
+	// All the controlled pods go, whether they match the selector or not.
+	controlled, err := c.controlledPods(ps)
+	if err != nil {
+		return err
+	}
+	if len(controlled) == 0 {
+		// The cache may still miss the pods the controller just created,
+		// the pod events requeue the PodSet once it caught up.
+		if !needsSync {
+			return nil
+		}
+		return c.removeOrderedTeardownFinalizer(ps)
+	}
+
+	terminating := 0
+	remaining := []*corev1.Pod{}
+	for _, p := range controlled {
+		if p.DeletionTimestamp != nil {
+			terminating++
+			continue
+		}
+		remaining = append(remaining, p)
+	}
+
+	// Don't delete more pods while the cache may still miss the deletions
+	// of the previous batch.
+	var deleteErr error
+	if batch := teardownBatchSize(ps) - terminating; needsSync && batch > 0 && len(remaining) > 0 {
+		victims := c.podsToDelete(ps, remaining, integerMin(batch, len(remaining)))
+		deleteErr = c.deletePodsWithOptions(ps, victims, &metav1.DeleteOptions{
+			GracePeriodSeconds: ps.Spec.TeardownGracePeriodSeconds,
+		})
+	}
+
+	selector, err := podSetSelector(ps)
+	if err != nil {
+		selector = labels.Everything()
+	}
+	newStatus := calculateStatus(ps, selector, filterActivePods(controlled), deleteErr)
+	setCondition(&newStatus, newCondition(v1alpha1.PodSetProgressing, corev1.ConditionTrue,
+		orderedTeardownReason, fmt.Sprintf("PodSet is tearing down, %d pods left of which %d are terminating.", len(controlled), terminating)))
+	if err := c.updatePodSetStatus(ps, newStatus); err != nil {
+		c.recorder.Eventf(ps, corev1.EventTypeWarning, failedUpdateStatusReason, "Error updating status: %v", err)
+		return err
+	}
+
+	return deleteErr
+}
+
+// controlledPods returns all the pods controlled by the PodSet.
+func (c *podSetController) controlledPods(ps *v1alpha1.PodSet) ([]*corev1.Pod, error) {
+	controlled := []*corev1.Pod{}
+
+	nc, err := c.cacheFor(ps.Namespace)
+	if err != nil {
+		return controlled, err
+	}
+	objs, err := nc.podIndexer.ByIndex(controllerUIDIndex, string(ps.UID))
+	if err != nil {
+		return controlled, fmt.Errorf("Error in retriving pods: %v", err)
+	}
+	for _, obj := range objs {
+		if p, ok := obj.(*corev1.Pod); ok && p.Namespace == ps.Namespace {
+			controlled = append(controlled, p)
+		}
+	}
+
+	return controlled, nil
+}
+
+// removeOrderedTeardownFinalizer lets the PodSet go once its pods are gone.
+func (c *podSetController) removeOrderedTeardownFinalizer(ps *v1alpha1.PodSet) error {
+	client := c.psc.DemoV1alpha1().PodSets(ps.Namespace)
+	err := c.updatePodSet(ps, client.Update, func(latest *v1alpha1.PodSet) bool {
+		finalizers := []string{}
+		for _, f := range latest.Finalizers {
+			if f != v1alpha1.OrderedTeardownFinalizer {
+				finalizers = append(finalizers, f)
+			}
+		}
+		if len(finalizers) == len(latest.Finalizers) {
+			return false
+		}
+		latest.Finalizers = finalizers
+		return true
+	})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	c.recorder.Event(ps, corev1.EventTypeNormal, teardownCompletedReason, "Deleted all pods, removed the ordered teardown finalizer")
+	return nil
+}
+
+func teardownBatchSize(ps *v1alpha1.PodSet) int {
+	if ps.Spec.TeardownBatchSize == nil || *ps.Spec.TeardownBatchSize < 1 {
+		return defaultTeardownBatchSize
+	}
+	return int(*ps.Spec.TeardownBatchSize)
+}
@@ -0,0 +1,146 @@
+// Package logging writes levelled log lines carrying key-value pairs through
+// klog, either as text or as JSON objects.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// TextFormat writes lines as `message key="value" ...`.
+	TextFormat = "text"
+	// JSONFormat writes lines as one JSON object each.
+	JSONFormat = "json"
+)
+
+var format = TextFormat
+
+// SetFormat sets the format of the log lines, klog headers must be skipped
+// for the JSON format.
+func SetFormat(f string) error {
+	switch f {
+	case TextFormat, JSONFormat:
+		format = f
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %q, must be %q or %q", f, TextFormat, JSONFormat)
+	}
+}
+
+// Logger writes log lines carrying its key-value pairs.
+type Logger struct {
+	keysAndValues []interface{}
+}
+
+// WithValues returns a logger adding the given key-value pairs to every line.
+func WithValues(keysAndValues ...interface{}) Logger {
+	return Logger{}.WithValues(keysAndValues...)
+}
+
+// WithValues returns a logger adding the given key-value pairs to every line,
+// after the ones of l.
+func (l Logger) WithValues(keysAndValues ...interface{}) Logger {
+	kv := make([]interface{}, 0, len(l.keysAndValues)+len(keysAndValues))
+	kv = append(kv, l.keysAndValues...)
+	kv = append(kv, keysAndValues...)
+	return Logger{keysAndValues: kv}
+}
+
+// Info logs a message at level 0.
+func (l Logger) Info(msg string, keysAndValues ...interface{}) {
+	klog.InfoDepth(1, l.line("info", msg, nil, keysAndValues))
+}
+
+// Error logs an error.
+func (l Logger) Error(err error, msg string, keysAndValues ...interface{}) {
+	klog.ErrorDepth(1, l.line("error", msg, err, keysAndValues))
+}
+
+// Verbose logs only if the verbosity is at least its level.
+type Verbose struct {
+	enabled bool
+	logger  Logger
+}
+
+// V returns a logger which logs only if the -v verbosity is at least level.
+func (l Logger) V(level klog.Level) Verbose {
+	return Verbose{enabled: bool(klog.V(level)), logger: l}
+}
+
+// Info logs a message if the verbosity is enabled.
+func (v Verbose) Info(msg string, keysAndValues ...interface{}) {
+	if v.enabled {
+		klog.InfoDepth(1, v.logger.line("info", msg, nil, keysAndValues))
+	}
+}
+
+// Info logs a message at level 0 without key-value pairs of its own.
+func Info(msg string, keysAndValues ...interface{}) {
+	klog.InfoDepth(1, Logger{}.line("info", msg, nil, keysAndValues))
+}
+
+// Error logs an error without key-value pairs of its own.
+func Error(err error, msg string, keysAndValues ...interface{}) {
+	klog.ErrorDepth(1, Logger{}.line("error", msg, err, keysAndValues))
+}
+
+// V returns a logger which logs only if the -v verbosity is at least level.
+func V(level klog.Level) Verbose {
+	return Logger{}.V(level)
+}
+
+func (l Logger) line(level, msg string, err error, keysAndValues []interface{}) string {
+	kv := append(append([]interface{}{}, l.keysAndValues...), keysAndValues...)
+	if err != nil {
+		kv = append(kv, "err", err)
+	}
+	if len(kv)%2 != 0 {
+		kv = append(kv, "(MISSING)")
+	}
+
+	if format == JSONFormat {
+		return jsonLine(level, msg, kv)
+	}
+	return textLine(msg, kv)
+}
+
+func textLine(msg string, kv []interface{}) string {
+	buf := &bytes.Buffer{}
+	buf.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		fmt.Fprintf(buf, " %v=%s", kv[i], strconv.Quote(fmt.Sprint(kv[i+1])))
+	}
+	return buf.String()
+}
+
+func jsonLine(level, msg string, kv []interface{}) string {
+	// keep the fixed fields first, encoding a map would sort them
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, `{"ts":%q,"level":%q,"msg":%s`,
+		time.Now().UTC().Format(time.RFC3339Nano), level, jsonValue(msg))
+	for i := 0; i < len(kv); i += 2 {
+		fmt.Fprintf(buf, ",%s:%s", jsonValue(fmt.Sprint(kv[i])), jsonValue(kv[i+1]))
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+func jsonValue(v interface{}) []byte {
+	switch v := v.(type) {
+	case error:
+		return jsonValue(v.Error())
+	case fmt.Stringer:
+		return jsonValue(v.String())
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return b
+}